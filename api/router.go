@@ -11,17 +11,44 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emilyzhang/crawlr/crawlerdb"
 )
 
+// defaultSearchLimit and maxSearchLimit are the default and maximum number of
+// search results returned at once.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// defaultMaxDistance is the default number of bits the simhashes of two pages
+// may differ in for them to be considered near duplicates.
+const defaultMaxDistance = 3
+
 // router routes requests to the correct handler.
 func (s *Server) router(w http.ResponseWriter, req *http.Request) {
 	s.Logger.Printf("New request: %s", req.URL.Path)
-	pathPattern := regexp.MustCompile(`/(status|results)/\d+`)
+	pathPattern := regexp.MustCompile(`/(status|results|canonicals|fetches|duplicates|warcs)/\d+`)
+	pagePattern := regexp.MustCompile(`^/pages/\d+(/fetches)?$`)
 	if req.URL.Path == "/crawl" && req.Method == http.MethodPost {
 		s.createHandler(w, req)
 		return
+	} else if req.URL.Path == "/search" && req.Method == http.MethodGet {
+		s.searchHandler(w, req)
+	} else if pagePattern.MatchString(req.URL.Path) && req.Method == http.MethodGet {
+		u := strings.Split(req.URL.Path, "/")
+		id, err := strconv.Atoi(u[2])
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "Invalid id submitted (id must be number): %s"}`, u[2]), http.StatusBadRequest)
+			return
+		}
+		if len(u) > 3 {
+			s.pageFetchesHandler(w, req, id)
+		} else {
+			s.pageHandler(w, req, id)
+		}
 	} else if pathPattern.MatchString(req.URL.Path) && req.Method == http.MethodGet {
 		u := strings.Split("/"+path.Clean(req.URL.Path), "/")
 		id, err := strconv.Atoi(u[3])
@@ -33,6 +60,14 @@ func (s *Server) router(w http.ResponseWriter, req *http.Request) {
 			s.statusHandler(w, req, id)
 		case "results":
 			s.resultsHandler(w, req, id)
+		case "canonicals":
+			s.canonicalsHandler(w, req, id)
+		case "fetches":
+			s.fetchStatsHandler(w, req, id)
+		case "duplicates":
+			s.duplicatesHandler(w, req, id)
+		case "warcs":
+			s.warcsHandler(w, req, id)
 		}
 	} else {
 		http.Error(w, fmt.Sprintf(`{"error": "Not a valid endpoint: %s"}`+req.URL.Path), http.StatusNotFound)
@@ -42,8 +77,17 @@ func (s *Server) router(w http.ResponseWriter, req *http.Request) {
 // createHandler specifies a handler for the / endpoint.
 func (s *Server) createHandler(w http.ResponseWriter, req *http.Request) {
 	c := &struct {
-		URL    string
-		Levels int
+		URL                string
+		Levels             int
+		MaxAge             int      `json:"max_age"`
+		FollowKinds        []string `json:"follow_kinds"`
+		SkipNofollow       bool     `json:"skip_nofollow"`
+		CollapseDuplicates bool     `json:"collapse_duplicates"`
+		UseSitemaps        bool     `json:"use_sitemaps"`
+		ReuseDuplicates    bool     `json:"reuse_duplicates"`
+		ArchiveWARC        bool     `json:"archive_warc"`
+		Priority           int      `json:"priority"`
+		Weight             int      `json:"weight"`
 	}{}
 
 	// Read request body.
@@ -58,19 +102,29 @@ func (s *Server) createHandler(w http.ResponseWriter, req *http.Request) {
 		s.Logger.Printf("Error from request %s: %s", req.URL.Path, err.Error())
 	}
 
-	id, err := s.db.CreateCrawlRequest(c.URL, c.Levels)
+	id, err := s.db.CreateCrawlRequestContext(req.Context(), c.URL, c.Levels, crawlerdb.CrawlOptions{
+		MaxAge:             c.MaxAge,
+		FollowKinds:        c.FollowKinds,
+		SkipNofollow:       c.SkipNofollow,
+		CollapseDuplicates: c.CollapseDuplicates,
+		UseSitemaps:        c.UseSitemaps,
+		ReuseDuplicates:    c.ReuseDuplicates,
+		ArchiveWARC:        c.ArchiveWARC,
+		Priority:           c.Priority,
+		Weight:             c.Weight,
+	})
 	if err != nil {
 		w.Write([]byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())))
 		s.Logger.Printf("Error from request %s: %s", req.URL.Path, err.Error())
 		return
 	}
-	resp := fmt.Sprintf(`{"crawl_request_id": %d, "levels": %d, "url": "%s"}`, id, c.Levels, c.URL)
+	resp := fmt.Sprintf(`{"crawl_request_id": %d, "levels": %d, "url": "%s", "max_age": %d, "priority": %d}`, id, c.Levels, c.URL, c.MaxAge, c.Priority)
 	w.Write([]byte(resp))
 }
 
 // statusHandler specifies a handler for the /status/<id> endpoint.
 func (s *Server) statusHandler(w http.ResponseWriter, req *http.Request, id int) {
-	cr, err := s.db.GetCrawlRequest(id)
+	cr, err := s.db.GetCrawlRequestContext(req.Context(), id)
 	if err != nil {
 		if err == crawlerdb.ErrDoesNotExist {
 			http.Error(w, fmt.Sprintf(`{"error": "There is no crawl request with this id: %d"}`, id), http.StatusInternalServerError)
@@ -79,20 +133,20 @@ func (s *Server) statusHandler(w http.ResponseWriter, req *http.Request, id int)
 		}
 		return
 	}
-	crStatuses, err := s.db.CrawlRequestStatus(id)
+	crStatuses, err := s.db.CrawlRequestStatusContext(req.Context(), id)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
 		return
 	}
 	var status string
-	total := crStatuses.InProgress + crStatuses.Completed + crStatuses.Failed
-	status = fmt.Sprintf(`{"url": "%s", "crawl_request_id": %d, "completed": %d, "failed": %d, "in_progress": %d, "total": %d}`, cr.URL, id, crStatuses.Completed, crStatuses.Failed, crStatuses.InProgress, total)
+	total := crStatuses.InProgress + crStatuses.Completed + crStatuses.Failed + crStatuses.Blocked + crStatuses.Retrying
+	status = fmt.Sprintf(`{"url": "%s", "crawl_request_id": %d, "completed": %d, "failed": %d, "blocked": %d, "in_progress": %d, "retrying": %d, "total": %d, "redirected": %d}`, cr.URL, id, crStatuses.Completed, crStatuses.Failed, crStatuses.Blocked, crStatuses.InProgress, crStatuses.Retrying, total, crStatuses.Redirected)
 	w.Write([]byte(status))
 }
 
 // resultsHandler specifies a handler for the /results/<id> endpoint.
 func (s *Server) resultsHandler(w http.ResponseWriter, req *http.Request, id int) {
-	cr, err := s.db.GetCrawlRequest(id)
+	cr, err := s.db.GetCrawlRequestContext(req.Context(), id)
 	if err != nil {
 		if err == crawlerdb.ErrDoesNotExist {
 			http.Error(w, fmt.Sprintf(`{"error": "There is no crawl request with this id: %d"}`, id), http.StatusInternalServerError)
@@ -101,7 +155,7 @@ func (s *Server) resultsHandler(w http.ResponseWriter, req *http.Request, id int
 		}
 		return
 	}
-	tasks, err := s.db.GetCrawlRequestTasks(id)
+	tasks, err := s.db.GetCrawlRequestTasksContext(req.Context(), id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -119,9 +173,366 @@ func (s *Server) resultsHandler(w http.ResponseWriter, req *http.Request, id int
 	w.Write([]byte(string(h)))
 }
 
+// canonicalsHandler specifies a handler for the /canonicals/<id> endpoint.
+func (s *Server) canonicalsHandler(w http.ResponseWriter, req *http.Request, id int) {
+	_, err := s.db.GetCrawlRequestContext(req.Context(), id)
+	if err != nil {
+		if err == crawlerdb.ErrDoesNotExist {
+			http.Error(w, fmt.Sprintf(`{"error": "There is no crawl request with this id: %d"}`, id), http.StatusInternalServerError)
+		} else {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		}
+		return
+	}
+	mismatches, err := s.db.GetCanonicalMismatchesContext(req.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	type canonical struct {
+		URL                 string `json:"url"`
+		CanonicalURL        string `json:"canonical_url"`
+		Collapsed           bool   `json:"collapsed"`
+		CanonicalStatusCode int    `json:"canonical_status_code"`
+		Broken              bool   `json:"broken"`
+		Chain               bool   `json:"chain"`
+		CrossHost           bool   `json:"cross_host"`
+	}
+	canonicals := make([]canonical, 0, len(mismatches))
+	for _, m := range mismatches {
+		canonicals = append(canonicals, canonical(*m))
+	}
+	c, err := json.Marshal(canonicals)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(c)
+}
+
+// duplicatesHandler specifies a handler for the /duplicates/<id> endpoint. The
+// max_distance query parameter sets how many bits the simhashes of near
+// duplicates may differ in, and defaults to defaultMaxDistance.
+func (s *Server) duplicatesHandler(w http.ResponseWriter, req *http.Request, id int) {
+	maxDistance := defaultMaxDistance
+	if v := req.URL.Query().Get("max_distance"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > 64 {
+			http.Error(w, fmt.Sprintf(`{"error": "Invalid max_distance submitted (must be a number between 0 and 64): %s"}`, v), http.StatusBadRequest)
+			return
+		}
+		maxDistance = d
+	}
+	_, err := s.db.GetCrawlRequestContext(req.Context(), id)
+	if err != nil {
+		if err == crawlerdb.ErrDoesNotExist {
+			http.Error(w, fmt.Sprintf(`{"error": "There is no crawl request with this id: %d"}`, id), http.StatusInternalServerError)
+		} else {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		}
+		return
+	}
+	clusters, err := s.db.GetDuplicateClustersContext(req.Context(), id, maxDistance)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	type exact struct {
+		ContentHash string   `json:"content_hash"`
+		URLs        []string `json:"urls"`
+	}
+	type near struct {
+		MaxDistance int      `json:"max_distance"`
+		URLs        []string `json:"urls"`
+	}
+	resp := struct {
+		CrawlRequestID int     `json:"crawl_request_id"`
+		Exact          []exact `json:"exact"`
+		Near           []near  `json:"near"`
+	}{CrawlRequestID: id, Exact: []exact{}, Near: []near{}}
+	for _, c := range clusters {
+		if c.Exact {
+			resp.Exact = append(resp.Exact, exact{ContentHash: c.ContentHash, URLs: c.URLs})
+		} else {
+			resp.Near = append(resp.Near, near{MaxDistance: c.MaxDistance, URLs: c.URLs})
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// warcsHandler specifies a handler for the /warcs/<id> endpoint.
+func (s *Server) warcsHandler(w http.ResponseWriter, req *http.Request, id int) {
+	_, err := s.db.GetCrawlRequestContext(req.Context(), id)
+	if err != nil {
+		if err == crawlerdb.ErrDoesNotExist {
+			http.Error(w, fmt.Sprintf(`{"error": "There is no crawl request with this id: %d"}`, id), http.StatusInternalServerError)
+		} else {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		}
+		return
+	}
+	records, err := s.db.GetWARCRecordsContext(req.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	type record struct {
+		RecordID  string `json:"record_id"`
+		Type      string `json:"type"`
+		TargetURI string `json:"target_uri"`
+		Offset    int64  `json:"offset"`
+		Length    int64  `json:"length"`
+	}
+	type file struct {
+		Filename string   `json:"filename"`
+		Records  []record `json:"records"`
+	}
+	// records are ordered by file, so they can be grouped as they come
+	files := make([]*file, 0)
+	for _, r := range records {
+		if len(files) == 0 || files[len(files)-1].Filename != r.Filename {
+			files = append(files, &file{Filename: r.Filename})
+		}
+		f := files[len(files)-1]
+		f.Records = append(f.Records, record{r.RecordID, r.Type, r.TargetURI, r.Offset, r.Length})
+	}
+	b, err := json.Marshal(files)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// searchHandler specifies a handler for the /search endpoint. The q query
+// parameter is the search query, and crawl_request_id optionally limits the
+// search to the pages of a single crawl request. limit and offset page through
+// the results.
+func (s *Server) searchHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, `{"error": "Missing search query (q)"}`, http.StatusBadRequest)
+		return
+	}
+	params := map[string]int{"crawl_request_id": 0, "limit": defaultSearchLimit, "offset": 0}
+	for name := range params {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf(`{"error": "Invalid %s submitted (must be a positive number): %s"}`, name, v), http.StatusBadRequest)
+			return
+		}
+		params[name] = n
+	}
+	if params["limit"] == 0 || params["limit"] > maxSearchLimit {
+		params["limit"] = maxSearchLimit
+	}
+	results, err := s.db.SearchPagesContext(req.Context(), q, params["crawl_request_id"], params["limit"], params["offset"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	type result struct {
+		PageID  int     `json:"page_id"`
+		URL     string  `json:"url"`
+		Title   string  `json:"title"`
+		Rank    float64 `json:"rank"`
+		Snippet string  `json:"snippet"`
+	}
+	resp := struct {
+		Query          string   `json:"query"`
+		CrawlRequestID int      `json:"crawl_request_id,omitempty"`
+		Results        []result `json:"results"`
+	}{Query: q, CrawlRequestID: params["crawl_request_id"], Results: make([]result, 0, len(results))}
+	for _, r := range results {
+		resp.Results = append(resp.Results, result(*r))
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// pageHandler specifies a handler for the /pages/<id> endpoint.
+func (s *Server) pageHandler(w http.ResponseWriter, req *http.Request, id int) {
+	page, err := s.db.GetPageContext(req.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	metadata, err := s.db.GetPageMetadataContext(req.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	resp := struct {
+		ID            int               `json:"id"`
+		URL           string            `json:"url"`
+		Crawled       bool              `json:"crawled"`
+		FetchedAt     *time.Time        `json:"fetched_at,omitempty"`
+		StatusCode    int               `json:"status_code,omitempty"`
+		MediaType     string            `json:"media_type,omitempty"`
+		Charset       string            `json:"charset,omitempty"`
+		ContentLength int64             `json:"content_length"`
+		NoIndex       bool              `json:"noindex"`
+		CanonicalURL  string            `json:"canonical_url,omitempty"`
+		Title         string            `json:"title"`
+		Description   string            `json:"description"`
+		Lang          string            `json:"lang"`
+		H1s           []string          `json:"h1s"`
+		WordCount     int               `json:"word_count"`
+		OpenGraph     map[string]string `json:"open_graph"`
+		Twitter       map[string]string `json:"twitter"`
+	}{
+		ID:            page.ID,
+		URL:           page.URL,
+		Crawled:       page.CrawledStatus,
+		StatusCode:    page.StatusCode,
+		MediaType:     page.MediaType,
+		Charset:       page.Charset,
+		ContentLength: page.ContentLength,
+		NoIndex:       page.NoIndex,
+		CanonicalURL:  page.CanonicalURL,
+		Title:         metadata.Title,
+		Description:   metadata.Description,
+		Lang:          metadata.Lang,
+		H1s:           metadata.H1s,
+		WordCount:     metadata.WordCount,
+		OpenGraph:     metadata.OpenGraph,
+		Twitter:       metadata.Twitter,
+	}
+	if !page.FetchedAt.IsZero() {
+		resp.FetchedAt = &page.FetchedAt
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// pageFetchesHandler specifies a handler for the /pages/<id>/fetches endpoint.
+func (s *Server) pageFetchesHandler(w http.ResponseWriter, req *http.Request, id int) {
+	fetches, err := s.db.GetPageFetchesContext(req.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	type fetch struct {
+		CrawlRequestID int               `json:"crawl_request_id,omitempty"`
+		URL            string            `json:"url"`
+		FinalURL       string            `json:"final_url,omitempty"`
+		StatusCode     int               `json:"status_code,omitempty"`
+		Header         map[string]string `json:"headers"`
+		Bytes          int64             `json:"bytes"`
+		ContentType    string            `json:"content_type,omitempty"`
+		ErrorClass     string            `json:"error_class,omitempty"`
+		DNS            float64           `json:"dns_ms"`
+		Connect        float64           `json:"connect_ms"`
+		TLS            float64           `json:"tls_ms"`
+		TTFB           float64           `json:"ttfb_ms"`
+		Total          float64           `json:"total_ms"`
+		FetchedAt      time.Time         `json:"fetched_at"`
+	}
+	resp := make([]fetch, 0, len(fetches))
+	for _, f := range fetches {
+		resp = append(resp, fetch{
+			CrawlRequestID: f.CrawlRequestID,
+			URL:            f.URL,
+			FinalURL:       f.FinalURL,
+			StatusCode:     f.StatusCode,
+			Header:         f.Header,
+			Bytes:          f.Bytes,
+			ContentType:    f.ContentType,
+			ErrorClass:     f.ErrorClass,
+			DNS:            milliseconds(f.DNS),
+			Connect:        milliseconds(f.Connect),
+			TLS:            milliseconds(f.TLS),
+			TTFB:           milliseconds(f.TTFB),
+			Total:          milliseconds(f.Total),
+			FetchedAt:      f.FetchedAt,
+		})
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// fetchStatsHandler specifies a handler for the /fetches/<id> endpoint.
+func (s *Server) fetchStatsHandler(w http.ResponseWriter, req *http.Request, id int) {
+	_, err := s.db.GetCrawlRequestContext(req.Context(), id)
+	if err != nil {
+		if err == crawlerdb.ErrDoesNotExist {
+			http.Error(w, fmt.Sprintf(`{"error": "There is no crawl request with this id: %d"}`, id), http.StatusInternalServerError)
+		} else {
+			http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		}
+		return
+	}
+	stats, err := s.db.GetFetchStatsContext(req.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	type bucket struct {
+		Bucket string `json:"bucket"`
+		Count  int    `json:"count"`
+	}
+	histogram := make([]bucket, 0, len(stats.Latency))
+	for i, count := range stats.Latency {
+		var label string
+		switch {
+		case i == 0:
+			label = fmt.Sprintf("<%dms", crawlerdb.LatencyBuckets[0])
+		case i == len(crawlerdb.LatencyBuckets):
+			label = fmt.Sprintf(">=%dms", crawlerdb.LatencyBuckets[i-1])
+		default:
+			label = fmt.Sprintf("%d-%dms", crawlerdb.LatencyBuckets[i-1], crawlerdb.LatencyBuckets[i])
+		}
+		histogram = append(histogram, bucket{Bucket: label, Count: count})
+	}
+	resp := struct {
+		CrawlRequestID   int            `json:"crawl_request_id"`
+		Count            int            `json:"count"`
+		StatusCodes      map[int]int    `json:"status_codes"`
+		ErrorClasses     map[string]int `json:"error_classes"`
+		P50              float64        `json:"p50_ms"`
+		P90              float64        `json:"p90_ms"`
+		P99              float64        `json:"p99_ms"`
+		LatencyHistogram []bucket       `json:"latency_histogram"`
+	}{id, stats.Count, stats.StatusCodes, stats.ErrorClasses,
+		milliseconds(stats.P50), milliseconds(stats.P90), milliseconds(stats.P99), histogram}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "%s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// milliseconds converts a duration to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
 // hostCounter is a helperfunction for resultsHandler that takes in a list of
-// tasks and returns a count of all hosts traversed during those tasks. Returns
-// a nil map if CrawlRequest is not yet done.
+// tasks and returns a count of all hosts traversed during those tasks, leaving
+// out noindex pages. Returns a nil map if CrawlRequest is not yet done.
 func (s *Server) hostCounter(tasks []*crawlerdb.Task, crawlRequestID int, originalURL string) (map[string]int, error) {
 	hosts := make(map[string]int, 0)
 	o, err := url.Parse(originalURL)
@@ -130,9 +541,13 @@ func (s *Server) hostCounter(tasks []*crawlerdb.Task, crawlRequestID int, origin
 	}
 	originalHost := o.Hostname()
 	for _, t := range tasks {
-		if t.Status == "IN_PROGRESS" || t.Status == "NOT_STARTED" {
+		if t.Status == "IN_PROGRESS" || t.Status == "NOT_STARTED" || t.Status == "RETRYING" {
 			return hosts, errors.New(`{"error": "crawl request not yet completed"}`)
 		}
+		// pages that asked not to be indexed are left out of the results
+		if t.NoIndex {
+			continue
+		}
 		u, err := url.Parse(t.PageURL)
 		if err != nil {
 			s.Logger.Printf("CrawlRequest %d: Error parsing url %s for task %d: %v", t.CrawlRequestID, t.PageURL, t.ID, err.Error())
@@ -145,6 +560,18 @@ func (s *Server) hostCounter(tasks []*crawlerdb.Task, crawlRequestID int, origin
 				hosts[host] = 1
 			}
 		}
+		// count the host a redirect chain ended up at as well, if it's different
+		if t.FinalURL == "" {
+			continue
+		}
+		f, err := url.Parse(t.FinalURL)
+		if err != nil {
+			s.Logger.Printf("CrawlRequest %d: Error parsing final url %s for task %d: %v", t.CrawlRequestID, t.FinalURL, t.ID, err.Error())
+			continue
+		}
+		if host := f.Hostname(); host != originalHost && host != u.Hostname() {
+			hosts[host]++
+		}
 	}
 	return hosts, nil
 }
@@ -1,45 +1,69 @@
 package api
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/urlcanon"
 )
 
 // Server represents an API server containing a database client and a logger.
 type Server struct {
 	Logger *log.Logger
 	db     *crawlerdb.Postgres
+	srv    *http.Server
 }
 
-// New creates a new API Server.
-func New(dbDSN string) (*Server, error) {
+// New creates a new API Server, which canonicalizes urls using the given
+// canonicalizer.
+func New(dbDSN string, canon *urlcanon.Canonicalizer) (*Server, error) {
 	// tries connecting to the database 3 times until it gives up
 	retries, count, sleep := 3, 0, 5
-	db, err := crawlerdb.New(dbDSN)
+	db, err := crawlerdb.New(dbDSN, canon)
 	for err != nil {
 		if count > retries {
 			return nil, err
 		}
 		time.Sleep(time.Duration(sleep) * time.Second)
 		sleep += 3
-		db, err = crawlerdb.New(dbDSN)
+		db, err = crawlerdb.New(dbDSN, canon)
 		count++
 	}
 
-	return &Server{
+	s := &Server{
 		Logger: log.New(os.Stdout, "", 0),
 		db:     db,
-	}, nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.router)
+	s.srv = &http.Server{Addr: ":8000", Handler: mux}
+	return s, nil
 }
 
-// Start starts the server.
-func (s *Server) Start() {
-	http.HandleFunc("/", s.router)
+// Start starts the server. It returns once the server is shut down, or fails
+// to listen for connections.
+func (s *Server) Start() error {
 	s.Logger.Print("Starting API server. Hello world!")
-	http.ListenAndServe(":8000", nil)
-	// TODO: implement graceful server shut down
+	err := s.srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting connections
+// and waits for the requests in progress to finish, until ctx expires. Then it
+// closes the server's database connections.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		// drop the requests still in progress
+		s.srv.Close()
+	}
+	s.db.Close()
+	return err
 }
@@ -1,22 +1,54 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/emilyzhang/crawlr/api"
+	"github.com/emilyzhang/crawlr/urlcanon"
 )
 
 func main() {
 	// Get configuration.
 	dbDSN := flag.String("dsn", "", "connection data source name")
+	stripParams := flag.String("strip-params", strings.Join(urlcanon.DefaultStripParams, ","), "comma separated query parameters removed from urls")
+	unifySchemes := flag.Bool("unify-schemes", false, "treat http and https urls as the same page")
+	stripTrailingSlash := flag.Bool("strip-trailing-slash", false, "treat urls with and without a trailing slash as the same page")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 25*time.Second, "maximum amount of time spent finishing requests in progress when shutting down")
 	flag.Parse()
 
 	// Create api server and run it.
-	s, err := api.New(*dbDSN)
+	s, err := api.New(*dbDSN, &urlcanon.Canonicalizer{
+		StripParams:        strings.Split(*stripParams, ","),
+		UnifySchemes:       *unifySchemes,
+		StripTrailingSlash: *stripTrailingSlash,
+	})
 	if err != nil {
 		fmt.Println("Unable to start API server.")
 		panic(err)
 	}
-	s.Start()
+	errs := make(chan error, 1)
+	go func() { errs <- s.Start() }()
+
+	// Shut down gracefully when asked to stop.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		fmt.Println("API server stopped unexpectedly.")
+		panic(err)
+	case <-sig:
+	}
+	fmt.Println("Shutting down API server.")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		fmt.Printf("Dropped requests in progress: %v\n", err)
+	}
 }
@@ -1,23 +1,139 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/emilyzhang/crawlr/graphcrawler"
+	"github.com/emilyzhang/crawlr/urlcanon"
+	"github.com/emilyzhang/crawlr/warc"
 )
 
 func main() {
 	// Get configuration.
 	dbDSN := flag.String("dsn", "", "connection data source name")
-	maxWorkers := flag.Int("max-workers", 20, "maximum number of workers")
+	maxWorkers := flag.Int("max-workers", 20, "number of workers crawling at a time")
+	claimBatchSize := flag.Int("claim-batch-size", 10, "number of tasks claimed at once, and size of the prefetch buffer they wait in")
+	idleMinBackoff := flag.Duration("idle-min-backoff", 250*time.Millisecond, "minimum time an idle crawler waits before looking for tasks again")
+	idleMaxBackoff := flag.Duration("idle-max-backoff", 10*time.Second, "maximum time an idle crawler waits before looking for tasks again")
+	statsInterval := flag.Duration("stats-interval", time.Minute, "how often the utilization of the workers is logged")
+	hostMaxConns := flag.Int("host-max-conns", 2, "maximum number of concurrent requests to a single host")
+	hostMinDelay := flag.Duration("host-min-delay", time.Second, "minimum delay between requests to a single host")
+	maxRedirects := flag.Int("max-redirects", 10, "maximum number of redirects followed per page")
+	maxBodySize := flag.Int64("max-body-size", 10<<20, "maximum number of bytes of an html page that are downloaded")
+	maxSitemapURLs := flag.Int("max-sitemap-urls", 50000, "maximum number of pages taken from sitemaps per crawl request")
+	userAgent := flag.String("user-agent", "", "User-Agent header sent with every request (defaults to crawlr's)")
+	headers := flag.String("headers", "", "comma separated extra headers sent with every request, such as \"Accept-Language: en\"")
+	requestTimeout := flag.Duration("request-timeout", 2*time.Minute, "maximum amount of time a single request may take")
+	maxIdleConnsPerHost := flag.Int("max-idle-conns-per-host", 4, "maximum number of idle connections kept open to a single host")
+	warcDir := flag.String("warc-dir", "warcs", "directory WARC files are written to, or empty to never archive")
+	warcMaxSize := flag.Int64("warc-max-size", warc.DefaultMaxFileSize, "size in bytes after which a new WARC file is started")
+	retryMaxAttempts := flag.Int("retry-max-attempts", 5, "maximum number of times a task is attempted before it fails, or 1 to never retry")
+	retryBaseDelay := flag.Duration("retry-base-delay", 30*time.Second, "delay before a failed task is retried for the first time, doubling with every attempt")
+	retryMaxDelay := flag.Duration("retry-max-delay", time.Hour, "maximum delay before a failed task is retried")
+	retryErrors := flag.String("retry-errors", strings.Join(graphcrawler.DefaultRetryErrorClasses, ","), "comma separated classes of request errors that are retried (dns, connect, tls, timeout, reset, other)")
+	retryStatusCodes := flag.String("retry-status-codes", joinInts(graphcrawler.DefaultRetryStatusCodes), "comma separated response status codes that are retried")
+	workerID := flag.String("worker-id", "", "id of the crawler in the leases of the tasks it claims, unique across crawlers (defaults to the host name and process id)")
+	taskTimeout := flag.Duration("task-timeout", 10*time.Minute, "maximum amount of time spent on a single task, including every request and query it makes")
+	leaseDuration := flag.Duration("lease-duration", time.Minute, "how long a claimed task is leased to the crawler before another crawler may recover it")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 25*time.Second, "maximum amount of time spent finishing tasks in progress when shutting down")
+	stripParams := flag.String("strip-params", strings.Join(urlcanon.DefaultStripParams, ","), "comma separated query parameters removed from urls")
+	unifySchemes := flag.Bool("unify-schemes", false, "treat http and https urls as the same page")
+	stripTrailingSlash := flag.Bool("strip-trailing-slash", false, "treat urls with and without a trailing slash as the same page")
 	flag.Parse()
 
+	header := http.Header{}
+	for _, h := range strings.Split(*headers, ",") {
+		if i := strings.Index(h, ":"); i > 0 {
+			header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+		}
+	}
+
+	retry := graphcrawler.RetryPolicy{
+		MaxAttempts:  *retryMaxAttempts,
+		BaseDelay:    *retryBaseDelay,
+		MaxDelay:     *retryMaxDelay,
+		ErrorClasses: []string{},
+		StatusCodes:  []int{},
+	}
+	for _, class := range strings.Split(*retryErrors, ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			retry.ErrorClasses = append(retry.ErrorClasses, class)
+		}
+	}
+	for _, code := range strings.Split(*retryStatusCodes, ",") {
+		if code = strings.TrimSpace(code); code == "" {
+			continue
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			fmt.Printf("Invalid retry status code: %s\n", code)
+			panic(err)
+		}
+		retry.StatusCodes = append(retry.StatusCodes, n)
+	}
+
 	// Create graph crawler worker and run it.
-	w, err := graphcrawler.New(*dbDSN, *maxWorkers)
+	w, err := graphcrawler.New(*dbDSN, graphcrawler.Config{
+		MaxWorkers:         *maxWorkers,
+		ClaimBatchSize:     *claimBatchSize,
+		IdleMinBackoff:     *idleMinBackoff,
+		IdleMaxBackoff:     *idleMaxBackoff,
+		StatsInterval:      *statsInterval,
+		HostMaxConnections: *hostMaxConns,
+		HostMinDelay:       *hostMinDelay,
+		MaxRedirects:       *maxRedirects,
+		MaxBodySize:        *maxBodySize,
+		MaxSitemapURLs:     *maxSitemapURLs,
+		WARCDir:            *warcDir,
+		WARCMaxFileSize:    *warcMaxSize,
+		Retry:              retry,
+		WorkerID:           *workerID,
+		TaskTimeout:        *taskTimeout,
+		LeaseDuration:      *leaseDuration,
+		Fetcher: graphcrawler.NewHTTPFetcher(graphcrawler.FetcherConfig{
+			UserAgent:           *userAgent,
+			Header:              header,
+			Timeout:             *requestTimeout,
+			MaxIdleConnsPerHost: *maxIdleConnsPerHost,
+		}),
+		Canonicalizer: &urlcanon.Canonicalizer{
+			StripParams:        strings.Split(*stripParams, ","),
+			UnifySchemes:       *unifySchemes,
+			StripTrailingSlash: *stripTrailingSlash,
+		},
+	})
 	if err != nil {
 		fmt.Println("Unable to start crawler.")
 		panic(err)
 	}
-	w.Start()
+	go w.Start()
+
+	// Shut down gracefully when asked to stop.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	fmt.Println("Shutting down crawler.")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := w.Shutdown(ctx); err != nil {
+		fmt.Printf("Abandoned tasks in progress: %v\n", err)
+	}
+}
+
+// joinInts joins a list of numbers into a comma separated string.
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
 }
@@ -1,63 +1,110 @@
 package crawlerdb
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"strings"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
-// CreateCrawlRequest creates a new crawl request.
-func (p *Postgres) CreateCrawlRequest(urlString string, levels int) (int, error) {
+// CreateCrawlRequestContext creates a new crawl request with the given options.
+func (p *Postgres) CreateCrawlRequestContext(ctx context.Context, urlString string, levels int, opts CrawlOptions) (int, error) {
 	var id int
-	// clean url and make sure there's a scheme attached
-	pageURL, err := url.Parse(urlString)
+	// make sure there's a scheme attached and clean url
+	if !strings.Contains(urlString, "://") {
+		urlString = "http://" + urlString
+	}
+	pageURL, err := p.canon.Canonicalize(urlString)
 	if err != nil {
 		return id, fmt.Errorf("Unable to parse url %s: %v", urlString, err)
 	}
-	pageURL.Fragment = ""
-	if pageURL.Scheme == "" {
-		pageURL.Scheme = "http"
+	// make sure only known kinds of edges are followed
+	if len(opts.FollowKinds) == 0 {
+		opts.FollowKinds = []string{EdgeKindNavigation}
+	}
+	for _, k := range opts.FollowKinds {
+		if !isLinkEdgeKind(k) {
+			return id, fmt.Errorf("Unknown edge kind %s, must be one of: %s", k, strings.Join(LinkEdgeKinds, ", "))
+		}
+	}
+	if opts.Weight == 0 {
+		opts.Weight = 1
+	} else if opts.Weight < 0 {
+		return id, fmt.Errorf("Invalid weight %d, must be a positive number", opts.Weight)
 	}
 
-	// create new crawl request
-	result := p.db.QueryRow(
+	// create new crawl request, which starts out level with the crawl requests
+	// that are already running, rather than getting every worker until it has
+	// caught up with them
+	result := p.db.QueryRowContext(ctx,
 		`INSERT INTO crawl_requests
-		(id, url, levels)
-		VALUES (DEFAULT, $1, $2)
-		RETURNING id`, pageURL.String(), levels)
+		(id, url, levels, max_age, follow_kinds, skip_nofollow, collapse_duplicates, use_sitemaps, reuse_duplicates,
+			archive_warc, priority, weight, virtual_time)
+		VALUES (DEFAULT, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11,
+			COALESCE((SELECT MIN(cr.virtual_time) FROM crawl_requests cr
+				WHERE EXISTS (SELECT 1 FROM tasks t
+					WHERE t.crawl_request_id = cr.id AND t.status IN ($12, $13, $14))), 0))
+		RETURNING id`, pageURL, levels, opts.MaxAge, strings.Join(opts.FollowKinds, ","), opts.SkipNofollow,
+		opts.CollapseDuplicates, opts.UseSitemaps, opts.ReuseDuplicates, opts.ArchiveWARC, opts.Priority, opts.Weight,
+		"NOT_STARTED", "RETRYING", "IN_PROGRESS")
 	err = result.Scan(&id)
 	if err != nil {
 		return id, fmt.Errorf("Unable to create crawl request with url %s and level %d: %v", urlString, levels, err)
 	}
 	// create first task for crawl request
-	err = p.CreateTask(id, pageURL.String(), 0, false)
+	err = p.CreateTaskContext(ctx, id, pageURL, 0, false)
 	if err != nil {
 		return id, fmt.Errorf("Unable to create task for crawl request %d: %v", id, err)
 	}
 	return id, err
 }
 
-// GetCrawlRequest gets the crawl request associated with the given id.
-func (p *Postgres) GetCrawlRequest(id int) (*CrawlRequest, error) {
+// CreateCrawlRequest calls CreateCrawlRequestContext with a background context.
+func (p *Postgres) CreateCrawlRequest(urlString string, levels int, opts CrawlOptions) (int, error) {
+	return p.CreateCrawlRequestContext(context.Background(), urlString, levels, opts)
+}
+
+// GetCrawlRequestContext gets the crawl request associated with the given id.
+func (p *Postgres) GetCrawlRequestContext(ctx context.Context, id int) (*CrawlRequest, error) {
 	var cr CrawlRequest
-	result := p.db.QueryRow(
-		`SELECT id, url, levels
+	var followKinds string
+	result := p.db.QueryRowContext(ctx,
+		`SELECT id, url, levels, max_age, follow_kinds, skip_nofollow, collapse_duplicates, use_sitemaps, reuse_duplicates,
+				archive_warc, priority, weight
 			FROM crawl_requests
 			WHERE id = $1`, id)
-	err := result.Scan(&cr.ID, &cr.URL, &cr.Levels)
+	err := result.Scan(&cr.ID, &cr.URL, &cr.Levels, &cr.MaxAge, &followKinds, &cr.SkipNofollow,
+		&cr.CollapseDuplicates, &cr.UseSitemaps, &cr.ReuseDuplicates, &cr.ArchiveWARC, &cr.Priority, &cr.Weight)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get crawl request with id %d: %v", id, err)
 	}
+	cr.FollowKinds = strings.Split(followKinds, ",")
 	return &cr, nil
 }
 
-// CrawlRequestStatus returns information related to the status of a crawl
-// request.
-func (p *Postgres) CrawlRequestStatus(crawlRequestID int) (*CrawlRequestStatus, error) {
+// GetCrawlRequest calls GetCrawlRequestContext with a background context.
+func (p *Postgres) GetCrawlRequest(id int) (*CrawlRequest, error) {
+	return p.GetCrawlRequestContext(context.Background(), id)
+}
+
+// isLinkEdgeKind reports whether kind is one of LinkEdgeKinds.
+func isLinkEdgeKind(kind string) bool {
+	for _, k := range LinkEdgeKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// CrawlRequestStatusContext returns information related to the status of a
+// crawl request.
+func (p *Postgres) CrawlRequestStatusContext(ctx context.Context, crawlRequestID int) (*CrawlRequestStatus, error) {
 	var crs CrawlRequestStatus
-	rows, err := p.db.Query(
-		`SELECT status, COUNT(*)
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT status, COUNT(*), COUNT(final_url)
 		FROM tasks
 		WHERE crawl_request_id = $1
 		AND current_level < (SELECT levels FROM crawl_requests WHERE id = $1)
@@ -70,10 +117,11 @@ func (p *Postgres) CrawlRequestStatus(crawlRequestID int) (*CrawlRequestStatus,
 	// get status counts
 	for rows.Next() {
 		var status string
-		var count int
-		if err := rows.Scan(&status, &count); err != nil {
+		var count, redirected int
+		if err := rows.Scan(&status, &count, &redirected); err != nil {
 			return nil, fmt.Errorf("Unable to scan status for crawl request with id %d: %v", crawlRequestID, err)
 		}
+		crs.Redirected += redirected
 		switch status {
 		case "COMPLETED":
 			crs.Completed = count
@@ -81,19 +129,30 @@ func (p *Postgres) CrawlRequestStatus(crawlRequestID int) (*CrawlRequestStatus,
 			crs.InProgress = count
 		case "FAILED":
 			crs.Failed = count
+		case "BLOCKED":
+			crs.Blocked = count
+		case "RETRYING":
+			crs.Retrying = count
 		}
 	}
 	return &crs, nil
 }
 
-// GetCrawlRequestTasks returns all tasks crawled during a crawl request. If all URLs
-// have completed crawling, it is likely the crawl request is done.
-func (p *Postgres) GetCrawlRequestTasks(crawlRequestID int) ([]*Task, error) {
+// CrawlRequestStatus calls CrawlRequestStatusContext with a background context.
+func (p *Postgres) CrawlRequestStatus(crawlRequestID int) (*CrawlRequestStatus, error) {
+	return p.CrawlRequestStatusContext(context.Background(), crawlRequestID)
+}
+
+// GetCrawlRequestTasksContext returns all tasks crawled during a crawl request.
+// If all URLs have completed crawling, it is likely the crawl request is done.
+func (p *Postgres) GetCrawlRequestTasksContext(ctx context.Context, crawlRequestID int) ([]*Task, error) {
 	var tasks []*Task
-	rows, err := p.db.Query(
-		`SELECT id, crawl_request_id, page_url, current_level, status, seen_url
-		FROM tasks
-		WHERE crawl_request_id = $1`, crawlRequestID)
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT t.id, t.crawl_request_id, t.page_url, t.current_level, t.status, t.seen_url,
+			COALESCE(t.final_url, ''), COALESCE(p.noindex, false)
+		FROM tasks t
+		LEFT JOIN page_nodes p ON p.url = COALESCE(t.final_url, t.page_url)
+		WHERE t.crawl_request_id = $1`, crawlRequestID)
 	if err != nil {
 		return tasks, fmt.Errorf("Unable to get tasks for crawl request with id %d: %v", crawlRequestID, err)
 	}
@@ -101,10 +160,63 @@ func (p *Postgres) GetCrawlRequestTasks(crawlRequestID int) ([]*Task, error) {
 
 	for rows.Next() {
 		t := Task{}
-		if err := rows.Scan(&t.ID, &t.CrawlRequestID, &t.PageURL, &t.CurrentLevel, &t.Status, &t.SeenURL); err != nil {
+		if err := rows.Scan(&t.ID, &t.CrawlRequestID, &t.PageURL, &t.CurrentLevel, &t.Status, &t.SeenURL, &t.FinalURL, &t.NoIndex); err != nil {
 			return tasks, fmt.Errorf("Unable to scan tasks for crawl request with id %d: %v", crawlRequestID, err)
 		}
 		tasks = append(tasks, &t)
 	}
 	return tasks, nil
 }
+
+// GetCrawlRequestTasks calls GetCrawlRequestTasksContext with a background
+// context.
+func (p *Postgres) GetCrawlRequestTasks(crawlRequestID int) ([]*Task, error) {
+	return p.GetCrawlRequestTasksContext(context.Background(), crawlRequestID)
+}
+
+// GetCanonicalMismatchesContext returns the pages crawled during a crawl
+// request whose rel=canonical points at a different url, along with what's
+// wrong with their canonical page, if anything.
+func (p *Postgres) GetCanonicalMismatchesContext(ctx context.Context, crawlRequestID int) ([]*CanonicalMismatch, error) {
+	var mismatches []*CanonicalMismatch
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT DISTINCT p.url, p.canonical_url, p.alias_of IS NOT NULL,
+			COALESCE(c.status_code, 0), COALESCE(c.canonical_url, '')
+		FROM tasks t
+		JOIN page_nodes p ON p.url = t.page_url OR p.url = t.final_url
+		LEFT JOIN page_nodes c ON c.url = p.canonical_url
+		WHERE t.crawl_request_id = $1
+		AND p.canonical_url IS NOT NULL AND p.canonical_url != p.url
+		ORDER BY p.url`, crawlRequestID)
+	if err != nil {
+		return mismatches, fmt.Errorf("Unable to get canonical mismatches for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := CanonicalMismatch{}
+		var canonicalOfCanonical string
+		if err := rows.Scan(&m.URL, &m.CanonicalURL, &m.Collapsed, &m.CanonicalStatusCode, &canonicalOfCanonical); err != nil {
+			return mismatches, fmt.Errorf("Unable to scan canonical mismatches for crawl request with id %d: %v", crawlRequestID, err)
+		}
+		m.Broken = m.CanonicalStatusCode >= 400
+		m.Chain = canonicalOfCanonical != "" && canonicalOfCanonical != m.CanonicalURL
+		u, err := url.Parse(m.URL)
+		if err != nil {
+			return mismatches, err
+		}
+		c, err := url.Parse(m.CanonicalURL)
+		if err != nil {
+			return mismatches, err
+		}
+		m.CrossHost = u.Hostname() != c.Hostname()
+		mismatches = append(mismatches, &m)
+	}
+	return mismatches, nil
+}
+
+// GetCanonicalMismatches calls GetCanonicalMismatchesContext with a background
+// context.
+func (p *Postgres) GetCanonicalMismatches(crawlRequestID int) ([]*CanonicalMismatch, error) {
+	return p.GetCanonicalMismatchesContext(context.Background(), crawlRequestID)
+}
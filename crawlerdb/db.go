@@ -1,19 +1,32 @@
 package crawlerdb
 
 import (
+	"github.com/emilyzhang/crawlr/urlcanon"
 	"github.com/jmoiron/sqlx"
 )
 
 // Postgres represents a Postgres database client.
 type Postgres struct {
 	db *sqlx.DB
+	// canon canonicalizes every url before it's stored, so that the same page
+	// always ends up as the same page node.
+	canon *urlcanon.Canonicalizer
 }
 
-// New creates a new Postgres client.
-func New(dsn string) (*Postgres, error) {
+// New creates a new Postgres client, which canonicalizes urls using the given
+// canonicalizer.
+func New(dsn string, canon *urlcanon.Canonicalizer) (*Postgres, error) {
 	db, err := sqlx.Connect("pgx", dsn)
 	if err != nil {
 		return nil, err
 	}
-	return &Postgres{db: db}, err
+	if canon == nil {
+		canon = &urlcanon.Canonicalizer{}
+	}
+	return &Postgres{db: db, canon: canon}, err
+}
+
+// Close closes the database client's connections.
+func (p *Postgres) Close() error {
+	return p.db.Close()
 }
@@ -0,0 +1,179 @@
+package crawlerdb
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// FindDuplicatePageContext returns the id of the earliest crawled page node on
+// the same host as the given page node with exactly the same content, or 0 if
+// there is none. Pages that are duplicates themselves are skipped, so that
+// every duplicate points at the same original page.
+func (p *Postgres) FindDuplicatePageContext(ctx context.Context, page *Page) (int, error) {
+	var id int
+	if page.ContentHash == "" {
+		return id, nil
+	}
+	result := p.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MIN(id), 0)
+		FROM page_nodes
+		WHERE content_hash = $1 AND id != $2 AND duplicate_of IS NULL AND crawled_status
+		AND substring(url from '^[^:]+://([^/?#:]+)') = substring($3::text from '^[^:]+://([^/?#:]+)')`,
+		page.ContentHash, page.ID, page.URL)
+	err := result.Scan(&id)
+	if err != nil {
+		return id, fmt.Errorf("Unable to find duplicates of page %d: %v", page.ID, err)
+	}
+	return id, nil
+}
+
+// FindDuplicatePage calls FindDuplicatePageContext with a background context.
+func (p *Postgres) FindDuplicatePage(page *Page) (int, error) {
+	return p.FindDuplicatePageContext(context.Background(), page)
+}
+
+// GetDuplicateClustersContext returns the clusters of pages crawled during a
+// crawl request with exactly the same content, followed by the clusters of
+// pages whose simhashes differ in at most maxDistance bits.
+func (p *Postgres) GetDuplicateClustersContext(ctx context.Context, crawlRequestID int, maxDistance int) ([]*DuplicateCluster, error) {
+	var clusters []*DuplicateCluster
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT DISTINCT p.url, p.content_hash, p.simhash
+		FROM tasks t
+		JOIN page_nodes p ON p.url = t.page_url OR p.url = t.final_url
+		WHERE t.crawl_request_id = $1 AND p.content_hash IS NOT NULL
+		ORDER BY p.content_hash, p.url`, crawlRequestID)
+	if err != nil {
+		return clusters, fmt.Errorf("Unable to get content hashes for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	defer rows.Close()
+
+	// group pages by content hash first, every group is an exact cluster
+	var groups []*DuplicateCluster
+	var simhashes []uint64
+	for rows.Next() {
+		var url, hash string
+		var simhash int64
+		if err := rows.Scan(&url, &hash, &simhash); err != nil {
+			return clusters, fmt.Errorf("Unable to scan content hashes for crawl request with id %d: %v", crawlRequestID, err)
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ContentHash != hash {
+			groups = append(groups, &DuplicateCluster{Exact: true, ContentHash: hash})
+			simhashes = append(simhashes, uint64(simhash))
+		}
+		g := groups[len(groups)-1]
+		g.URLs = append(g.URLs, url)
+	}
+	if err := rows.Err(); err != nil {
+		return clusters, fmt.Errorf("Unable to scan content hashes for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	for _, g := range groups {
+		if len(g.URLs) > 1 {
+			clusters = append(clusters, g)
+		}
+	}
+
+	// then join groups whose simhashes are close enough into near clusters.
+	// Simhashes that differ in at most maxDistance bits are the same in at
+	// least one of maxDistance+1 bands of their bits, so only groups that
+	// share a band are compared
+	parent := make([]int, len(groups))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for _, b := range simhashBands(maxDistance) {
+		buckets := make(map[uint64][]int)
+		for i, h := range simhashes {
+			key := h >> b.shift & b.mask
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, bucket := range buckets {
+			for x, i := range bucket {
+				for _, j := range bucket[x+1:] {
+					if find(i) != find(j) && hammingDistance(simhashes[i], simhashes[j]) <= maxDistance {
+						parent[find(j)] = find(i)
+					}
+				}
+			}
+		}
+	}
+	members := make(map[int][]int)
+	var roots []int
+	for i := range groups {
+		root := find(i)
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], i)
+	}
+	for _, root := range roots {
+		m := members[root]
+		if len(m) < 2 {
+			continue
+		}
+		c := &DuplicateCluster{}
+		for x, i := range m {
+			c.URLs = append(c.URLs, groups[i].URLs...)
+			for _, j := range m[x+1:] {
+				if d := hammingDistance(simhashes[i], simhashes[j]); d > c.MaxDistance {
+					c.MaxDistance = d
+				}
+			}
+		}
+		sort.Strings(c.URLs)
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// GetDuplicateClusters calls GetDuplicateClustersContext with a background
+// context.
+func (p *Postgres) GetDuplicateClusters(crawlRequestID int, maxDistance int) ([]*DuplicateCluster, error) {
+	return p.GetDuplicateClustersContext(context.Background(), crawlRequestID, maxDistance)
+}
+
+// simhashBand represents a band of consecutive bits of a simhash.
+type simhashBand struct {
+	shift uint
+	mask  uint64
+}
+
+// simhashBands splits the 64 bits of a simhash into maxDistance+1 bands of
+// (nearly) equal width, so that simhashes that differ in at most maxDistance
+// bits are the same in at least one band. The default distance of 3 gives 4
+// bands of 16 bits. A distance of 64 or more matches every simhash, which is
+// a single band without any bits.
+func simhashBands(maxDistance int) []simhashBand {
+	if maxDistance >= 64 {
+		return []simhashBand{{}}
+	}
+	n := maxDistance + 1
+	if n < 1 {
+		n = 1
+	}
+	bands := make([]simhashBand, n)
+	shift := uint(0)
+	for i := range bands {
+		width := uint(64 / n)
+		if i < 64%n {
+			width++
+		}
+		bands[i] = simhashBand{shift: shift, mask: 1<<width - 1}
+		shift += width
+	}
+	return bands
+}
+
+// hammingDistance returns the number of bits two simhashes differ in.
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
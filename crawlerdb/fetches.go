@@ -0,0 +1,177 @@
+package crawlerdb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in milliseconds, of the buckets of the
+// fetch latency histogram. Fetches slower than the last bound fall into one
+// last bucket.
+var LatencyBuckets = []int{100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// AddPageFetchContext records a single http request made by the crawler.
+func (p *Postgres) AddPageFetchContext(ctx context.Context, f *PageFetch) error {
+	header, err := json.Marshal(f.Header)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal headers of fetch of %s: %v", f.URL, err)
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO page_fetches
+		(id, crawl_request_id, url, canonical_url, final_url, status_code, headers, bytes, content_type, error_class,
+			dns_ms, connect_ms, tls_ms, ttfb_ms, total_ms)
+		VALUES (DEFAULT, NULLIF($1, 0), $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, 0), $6::jsonb, $7, NULLIF($8, ''),
+			NULLIF($9, ''), $10, $11, $12, $13, $14)`,
+		f.CrawlRequestID, f.URL, f.CanonicalURL, f.FinalURL, f.StatusCode, string(header), f.Bytes, f.ContentType,
+		f.ErrorClass, milliseconds(f.DNS), milliseconds(f.Connect), milliseconds(f.TLS), milliseconds(f.TTFB),
+		milliseconds(f.Total))
+	if err != nil {
+		return fmt.Errorf("Unable to record fetch of %s: %v", f.URL, err)
+	}
+	return nil
+}
+
+// AddPageFetch calls AddPageFetchContext with a background context.
+func (p *Postgres) AddPageFetch(f *PageFetch) error {
+	return p.AddPageFetchContext(context.Background(), f)
+}
+
+// GetPageFetchesContext returns every recorded fetch of the page node with the
+// given id, whichever spelling of its url was requested, most recent first.
+func (p *Postgres) GetPageFetchesContext(ctx context.Context, pageID int) ([]*PageFetch, error) {
+	var fetches []*PageFetch
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT f.id, COALESCE(f.crawl_request_id, 0), f.url, COALESCE(f.canonical_url, ''), COALESCE(f.final_url, ''),
+			COALESCE(f.status_code, 0), COALESCE(f.headers, '{}')::text, f.bytes, COALESCE(f.content_type, ''),
+			COALESCE(f.error_class, ''),
+			f.dns_ms, f.connect_ms, f.tls_ms, f.ttfb_ms, f.total_ms, f.fetched_at
+		FROM page_fetches f
+		JOIN page_nodes p ON p.url = f.canonical_url
+		WHERE p.id = $1
+		ORDER BY f.id DESC`, pageID)
+	if err != nil {
+		return fetches, fmt.Errorf("Unable to get fetches for page %d: %v", pageID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := PageFetch{}
+		var header string
+		var dns, connect, tls, ttfb, total float64
+		if err := rows.Scan(&f.ID, &f.CrawlRequestID, &f.URL, &f.CanonicalURL, &f.FinalURL, &f.StatusCode, &header,
+			&f.Bytes, &f.ContentType, &f.ErrorClass, &dns, &connect, &tls, &ttfb, &total, &f.FetchedAt); err != nil {
+			return fetches, fmt.Errorf("Unable to scan fetches for page %d: %v", pageID, err)
+		}
+		if err := json.Unmarshal([]byte(header), &f.Header); err != nil {
+			return fetches, fmt.Errorf("Unable to unmarshal headers of fetch %d: %v", f.ID, err)
+		}
+		f.DNS, f.Connect, f.TLS, f.TTFB, f.Total = duration(dns), duration(connect), duration(tls), duration(ttfb), duration(total)
+		fetches = append(fetches, &f)
+	}
+	return fetches, nil
+}
+
+// GetPageFetches calls GetPageFetchesContext with a background context.
+func (p *Postgres) GetPageFetches(pageID int) ([]*PageFetch, error) {
+	return p.GetPageFetchesContext(context.Background(), pageID)
+}
+
+// GetFetchStatsContext returns aggregate statistics of the fetches made during
+// a crawl request.
+func (p *Postgres) GetFetchStatsContext(ctx context.Context, crawlRequestID int) (*FetchStats, error) {
+	stats := FetchStats{
+		StatusCodes:  make(map[int]int),
+		ErrorClasses: make(map[string]int),
+		Latency:      make([]int, len(LatencyBuckets)+1),
+	}
+
+	// latency percentiles
+	var p50, p90, p99 sql.NullFloat64
+	result := p.db.QueryRowContext(ctx,
+		`SELECT COUNT(*),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY total_ms),
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY total_ms),
+			percentile_cont(0.99) WITHIN GROUP (ORDER BY total_ms)
+		FROM page_fetches
+		WHERE crawl_request_id = $1`, crawlRequestID)
+	err := result.Scan(&stats.Count, &p50, &p90, &p99)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get fetch latencies for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	stats.P50, stats.P90, stats.P99 = duration(p50.Float64), duration(p90.Float64), duration(p99.Float64)
+
+	// latency histogram, width_bucket returns 0 for fetches below the first
+	// bound, and len(bounds) for fetches above the last one
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT width_bucket(total_ms, $2::float8[]), COUNT(*)
+		FROM page_fetches
+		WHERE crawl_request_id = $1
+		GROUP BY 1`, crawlRequestID, floatArray(LatencyBuckets))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get fetch latency histogram for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, fmt.Errorf("Unable to scan fetch latency histogram for crawl request with id %d: %v", crawlRequestID, err)
+		}
+		stats.Latency[bucket] = count
+	}
+
+	// status codes and error classes
+	rows, err = p.db.QueryContext(ctx,
+		`SELECT COALESCE(status_code, 0), COALESCE(error_class, ''), COUNT(*)
+		FROM page_fetches
+		WHERE crawl_request_id = $1
+		GROUP BY 1, 2`, crawlRequestID)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get fetch statuses for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var statusCode, count int
+		var errorClass string
+		if err := rows.Scan(&statusCode, &errorClass, &count); err != nil {
+			return nil, fmt.Errorf("Unable to scan fetch statuses for crawl request with id %d: %v", crawlRequestID, err)
+		}
+		if statusCode != 0 {
+			stats.StatusCodes[statusCode] += count
+		}
+		if errorClass != "" {
+			stats.ErrorClasses[errorClass] += count
+		}
+	}
+	return &stats, nil
+}
+
+// GetFetchStats calls GetFetchStatsContext with a background context.
+func (p *Postgres) GetFetchStats(crawlRequestID int) (*FetchStats, error) {
+	return p.GetFetchStatsContext(context.Background(), crawlRequestID)
+}
+
+// milliseconds converts a duration to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// duration converts fractional milliseconds to a duration.
+func duration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// floatArray formats integers as a postgres array literal, since the database
+// driver can't send arrays as parameters.
+func floatArray(values []int) string {
+	s := "{"
+	for i, v := range values {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprint(v)
+	}
+	return s + "}"
+}
@@ -0,0 +1,115 @@
+package crawlerdb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AcquireHostSlotContext reserves one of a host's maxConns concurrent
+// connection slots, provided that at least delay has passed since the last
+// request to the host was started by any crawler. The slot expires on its own
+// after ttl in case it is never released. It returns the id of the acquired
+// slot, or ErrHostOverBudget along with the earliest time a new attempt could
+// succeed.
+func (p *Postgres) AcquireHostSlotContext(ctx context.Context, host string, maxConns int, delay, ttl time.Duration) (int, time.Time, error) {
+	var id int
+	var retryAt time.Time
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to begin transaction for host %s: %v", host, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO host_budgets
+		(host)
+		VALUES ($1)
+		ON CONFLICT DO NOTHING`, host)
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to create budget for host %s: %v", host, err)
+	}
+
+	// lock the host's budget so that crawlers acquire slots for the same host
+	// one at a time
+	var nextRequestAt, now time.Time
+	result := tx.QueryRowContext(ctx,
+		`SELECT next_request_at, now()
+		FROM host_budgets
+		WHERE host = $1
+		FOR UPDATE`, host)
+	err = result.Scan(&nextRequestAt, &now)
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to get budget for host %s: %v", host, err)
+	}
+	if nextRequestAt.After(now) {
+		return id, nextRequestAt, ErrHostOverBudget
+	}
+
+	// forget about slots that were never released
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM host_connections
+		WHERE host = $1 AND expires_at <= now()`, host)
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to expire connections for host %s: %v", host, err)
+	}
+	var conns int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*)
+		FROM host_connections
+		WHERE host = $1`, host).Scan(&conns)
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to count connections for host %s: %v", host, err)
+	}
+	if conns >= maxConns {
+		// there's no telling when a connection will be released, so try again
+		// after the delay (or a second, if there is no delay)
+		wait := delay
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return id, now.Add(wait), ErrHostOverBudget
+	}
+
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO host_connections
+		(id, host, expires_at)
+		VALUES (DEFAULT, $1, now() + $2::float8 * interval '1 second')
+		RETURNING id`, host, ttl.Seconds()).Scan(&id)
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to create connection for host %s: %v", host, err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE host_budgets
+		SET next_request_at = now() + $2::float8 * interval '1 second'
+		WHERE host = $1`, host, delay.Seconds())
+	if err != nil {
+		return id, retryAt, fmt.Errorf("Unable to update budget for host %s: %v", host, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return id, retryAt, fmt.Errorf("Unable to acquire slot for host %s: %v", host, err)
+	}
+	return id, retryAt, nil
+}
+
+// AcquireHostSlot calls AcquireHostSlotContext with a background context.
+func (p *Postgres) AcquireHostSlot(host string, maxConns int, delay, ttl time.Duration) (int, time.Time, error) {
+	return p.AcquireHostSlotContext(context.Background(), host, maxConns, delay, ttl)
+}
+
+// ReleaseHostSlotContext releases a connection slot acquired with
+// AcquireHostSlot.
+func (p *Postgres) ReleaseHostSlotContext(ctx context.Context, id int) error {
+	_, err := p.db.ExecContext(ctx,
+		`DELETE FROM host_connections
+		WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("Unable to release host connection %d: %v", id, err)
+	}
+	return nil
+}
+
+// ReleaseHostSlot calls ReleaseHostSlotContext with a background context.
+func (p *Postgres) ReleaseHostSlot(id int) error {
+	return p.ReleaseHostSlotContext(context.Background(), id)
+}
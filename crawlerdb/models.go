@@ -1,10 +1,83 @@
 package crawlerdb
 
+import (
+	"time"
+)
+
 // Page represents a page node in the crawler graph.
 type Page struct {
 	ID            int
 	URL           string
 	CrawledStatus bool
+	// FetchedAt is the last time the page was fetched, or the zero time if it
+	// never was.
+	FetchedAt time.Time
+	// ETag and LastModified are the validators the page was last fetched with,
+	// used to revalidate the page with a conditional request.
+	ETag         string
+	LastModified string
+	// MediaType is the media type of the page when it was last fetched, such
+	// as "text/html".
+	MediaType string
+	// Charset is the character set an html page was encoded in when it was
+	// last fetched, such as "utf-8" or "shift_jis".
+	Charset string
+	// ContentLength is the size of the page's body in bytes when it was last
+	// fetched, or -1 if it is unknown.
+	ContentLength int64
+	// NoIndex is set if the page asked not to be indexed, through a robots
+	// meta tag or an X-Robots-Tag header.
+	NoIndex bool
+	// StatusCode is the http status code the page was last fetched with, or 0
+	// if it never was.
+	StatusCode int
+	// CanonicalURL is the url in the page's <link rel="canonical"> tag, if it
+	// has one.
+	CanonicalURL string
+	// AliasOf is the id of the canonical page node this page was collapsed
+	// into, or 0 if it wasn't.
+	AliasOf int
+	// ContentHash is a hash of the visible text of an html page when it was
+	// last fetched, which is the same for pages with exactly the same text. It
+	// is empty for pages without any text.
+	ContentHash string
+	// SimHash is a simhash of the visible text of an html page when it was
+	// last fetched, which only differs in a few bits for pages with nearly the
+	// same text.
+	SimHash uint64
+	// DuplicateOf is the id of an earlier crawled page node on the same host
+	// with the same ContentHash, or 0 if there is none.
+	DuplicateOf int
+}
+
+// PageMetadata represents what an html page says about itself.
+type PageMetadata struct {
+	Title       string
+	Description string
+	// Lang is the language in the page's <html lang> attribute, such as
+	// "en-US".
+	Lang string
+	// H1s are the texts of the page's <h1> headings, in order.
+	H1s []string
+	// WordCount is the number of words of visible text on the page.
+	WordCount int
+	// OpenGraph and Twitter hold the page's OpenGraph (og:*) and Twitter card
+	// (twitter:*) meta tags, keyed by property without its prefix, such as
+	// "title" or "image".
+	OpenGraph map[string]string
+	Twitter   map[string]string
+}
+
+// SearchResult represents a page matching a full-text search.
+type SearchResult struct {
+	PageID int
+	URL    string
+	Title  string
+	// Rank is how well the page matches the search, higher is better.
+	Rank float64
+	// Snippet holds the parts of the page's text that match the search best,
+	// with matching words wrapped in <b> tags.
+	Snippet string
 }
 
 // CrawlRequest represents a single crawl request.
@@ -12,13 +85,96 @@ type CrawlRequest struct {
 	ID     int
 	URL    string
 	Levels int
+	CrawlOptions
 }
 
+// CrawlOptions represents the options a CrawlRequest can be created with.
+type CrawlOptions struct {
+	// MaxAge is the number of seconds after which an already crawled page is
+	// considered stale and gets revalidated. Pages are never revalidated if it
+	// is 0.
+	MaxAge int
+	// FollowKinds are the kinds of edges that are followed to create new
+	// tasks, edges of other kinds are only recorded.
+	FollowKinds []string
+	// SkipNofollow makes the crawler not follow links with a rel attribute of
+	// nofollow, ugc or sponsored.
+	SkipNofollow bool
+	// CollapseDuplicates makes the crawler treat pages whose rel=canonical
+	// points at another page as aliases of that page, merging their links
+	// into the canonical page.
+	CollapseDuplicates bool
+	// UseSitemaps makes the crawler add tasks for every page listed in the
+	// sitemaps of the crawl request's host, alongside the links on the first
+	// page.
+	UseSitemaps bool
+	// ReuseDuplicates makes the crawler follow the links of an earlier crawled
+	// page with exactly the same content in place of the links of a duplicate
+	// page, so that duplicates such as session id and print view urls don't
+	// grow a parallel subgraph.
+	ReuseDuplicates bool
+	// ArchiveWARC makes the crawler write every http exchange made while
+	// crawling pages to WARC files.
+	ArchiveWARC bool
+	// Priority decides which crawl requests' tasks are crawled first: tasks
+	// of a crawl request are only claimed while no crawl request with a
+	// higher priority has tasks waiting.
+	Priority int
+	// Weight is the crawl request's share of the workers, relative to the
+	// other crawl requests with the same priority. It defaults to 1.
+	Weight int
+}
+
+// Edge kinds, describing how a source Page refers to a target Page.
+const (
+	// EdgeKindNavigation is a link that's meant to be followed, such as
+	// <a href>.
+	EdgeKindNavigation = "navigation"
+	// EdgeKindResource is a resource loaded by the page, such as <img src>.
+	EdgeKindResource = "resource"
+	// EdgeKindEmbed is a page embedded in the page, such as <iframe src>.
+	EdgeKindEmbed = "embed"
+	// EdgeKindForm is the target of a form on the page.
+	EdgeKindForm = "form"
+	// EdgeKindRefresh is the target of a <meta http-equiv="refresh"> tag.
+	EdgeKindRefresh = "refresh"
+	// EdgeKindRedirect is an http redirect from the source to the target.
+	EdgeKindRedirect = "redirect"
+	// EdgeKindSitemap is a page listed in the sitemaps of the source's host.
+	// Sitemap edges are only created from the first page of a crawl request.
+	EdgeKindSitemap = "sitemap"
+)
+
+// LinkEdgeKinds are the kinds of edges that can be created from links found on
+// a page, and that a crawl request can choose to follow.
+var LinkEdgeKinds = []string{EdgeKindNavigation, EdgeKindResource, EdgeKindEmbed, EdgeKindForm, EdgeKindRefresh}
+
 // Edge represents an edge between a source Page and a target Page.
 type Edge struct {
 	ID       int
 	SourceID int
 	TargetID int
+	// Kind is one of the EdgeKind constants.
+	Kind string
+	// StatusCode is the http status code of a redirect, and 0 otherwise.
+	StatusCode int
+	// Rel is the rel attribute of the link the edge was created from, such as
+	// "nofollow".
+	Rel string
+	// MergedFrom is the id of the alias page node the edge was merged from, or
+	// 0 if the edge was found on the source page itself.
+	MergedFrom int
+}
+
+// Link represents a link found on a page, which will become an edge from that
+// page to the page the link points to.
+type Link struct {
+	URL string
+	// Kind is one of the EdgeKind constants.
+	Kind string
+	// Rel is the normalized (lowercased, space separated) rel attribute of the
+	// link, if it had one.
+	Rel string
 }
 
 // Task represents a page to be crawled.
@@ -29,6 +185,119 @@ type Task struct {
 	CurrentLevel   int
 	Status         string
 	SeenURL        bool
+	// FinalURL is the url the task ended up crawling after following
+	// redirects, or empty if the task wasn't redirected.
+	FinalURL string
+	// NoIndex is set if the page the task crawled asked not to be indexed.
+	NoIndex bool
+	// Attempts is the number of times the task was attempted and failed.
+	Attempts int
+	// LastError is the error the last failed attempt of the task ended with.
+	LastError string
+	// ClaimedBy is the id of the worker holding the lease on an in progress
+	// task, and LeaseExpiresAt is when the lease runs out unless the worker
+	// extends it.
+	ClaimedBy      string
+	LeaseExpiresAt time.Time
+}
+
+// CanonicalMismatch represents a page crawled during a CrawlRequest whose
+// rel=canonical points at a different url.
+type CanonicalMismatch struct {
+	URL          string
+	CanonicalURL string
+	// Collapsed is set if the page was collapsed into its canonical page.
+	Collapsed bool
+	// CanonicalStatusCode is the http status code the canonical page was last
+	// fetched with, or 0 if it never was.
+	CanonicalStatusCode int
+	// Broken is set if the canonical page couldn't be fetched.
+	Broken bool
+	// Chain is set if the canonical page declares yet another canonical url.
+	Chain bool
+	// CrossHost is set if the canonical page is on a different host.
+	CrossHost bool
+}
+
+// DuplicateCluster represents a group of pages crawled during a CrawlRequest
+// with exactly or nearly the same content.
+type DuplicateCluster struct {
+	// Exact is set if every page in the cluster has exactly the same content,
+	// in which case ContentHash is their content hash.
+	Exact       bool
+	ContentHash string
+	URLs        []string
+	// MaxDistance is the largest number of bits the simhashes of two pages in
+	// a near duplicate cluster differ in.
+	MaxDistance int
+}
+
+// PageFetch represents a single http request made by the crawler.
+type PageFetch struct {
+	ID int
+	// CrawlRequestID is the id of the crawl request the request was made for,
+	// or 0 if it wasn't made for a single crawl request, such as robots.txt
+	// requests.
+	CrawlRequestID int
+	URL            string
+	// CanonicalURL is the canonical form of URL, which is the url of the page
+	// node the request was made for. It is empty if URL can't be
+	// canonicalized.
+	CanonicalURL string
+	// FinalURL is the url the response came from, which is where it redirects
+	// to for redirects.
+	FinalURL   string
+	StatusCode int
+	// Header holds a selection of the response's headers.
+	Header      map[string]string
+	Bytes       int64
+	ContentType string
+	// ErrorClass describes why the request failed, and is empty if it
+	// succeeded. It is one of "dns", "connect", "tls", "timeout", "reset",
+	// "http_4xx", "http_5xx", "body" or "other".
+	ErrorClass string
+	// DNS, Connect, TLS, TTFB and Total break down how long the request took.
+	// DNS, Connect and TLS are 0 when a connection was reused.
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	TTFB      time.Duration
+	Total     time.Duration
+	FetchedAt time.Time
+}
+
+// FetchStats represents aggregate statistics of the fetches made during a
+// CrawlRequest.
+type FetchStats struct {
+	Count int
+	// StatusCodes and ErrorClasses count fetches by status code and error
+	// class.
+	StatusCodes  map[int]int
+	ErrorClasses map[string]int
+	// Latency counts fetches by total duration, bucketed by LatencyBuckets.
+	Latency []int
+	// P50, P90 and P99 are percentiles of the total duration of fetches.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// WARCRecord represents where a WARC record written for a CrawlRequest is
+// stored.
+type WARCRecord struct {
+	ID             int
+	CrawlRequestID int
+	// RecordID is the record's WARC-Record-ID.
+	RecordID string
+	// Type is the record's WARC-Type, such as "response".
+	Type      string
+	TargetURI string
+	// Filename is the name of the WARC file the record is in, and Offset and
+	// Length are the position and size of the record's gzip member in it.
+	Filename  string
+	Offset    int64
+	Length    int64
+	CreatedAt time.Time
 }
 
 // CrawlRequestStatus represents the status of a CrawlRequest.
@@ -36,4 +305,13 @@ type CrawlRequestStatus struct {
 	Completed  int
 	Failed     int
 	InProgress int
+	// Blocked is the number of tasks that were skipped because their url was
+	// disallowed by robots.txt.
+	Blocked int
+	// Retrying is the number of tasks that failed with a transient error, and
+	// are waiting to be tried again.
+	Retrying int
+	// Redirected is the number of tasks whose page redirected to another
+	// page, regardless of their status.
+	Redirected int
 }
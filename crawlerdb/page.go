@@ -1,93 +1,435 @@
 package crawlerdb
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 )
 
-// UpsertPage creates a new page node if a page node with that url doesn't
-// already exist, otherwise it returns the existing page node.
-func (p *Postgres) UpsertPage(url string) (int, error) {
+// UpsertPageContext creates a new page node if a page node with the canonical
+// form of that url doesn't already exist, otherwise it returns the existing
+// page node.
+func (p *Postgres) UpsertPageContext(ctx context.Context, url string) (int, error) {
 	var id int
-	result := p.db.QueryRow(
+	url, err := p.canon.Canonicalize(url)
+	if err != nil {
+		return id, fmt.Errorf("Unable to upsert page: %v", err)
+	}
+	result := p.db.QueryRowContext(ctx,
 		`INSERT INTO page_nodes
 		(id, url, crawled_status)
 		VALUES (DEFAULT, $1, $2)
 		ON CONFLICT (url) DO UPDATE SET url=$1
 		RETURNING id`, url, false)
-	err := result.Scan(&id)
+	err = result.Scan(&id)
 	if err != nil {
 		return id, fmt.Errorf("Unable to upsert page with url %s: %v", url, err)
 	}
 	return id, err
 }
 
-// GetPage returns the page node associated with the given id.
-func (p *Postgres) GetPage(id int) (*Page, error) {
+// UpsertPage calls UpsertPageContext with a background context.
+func (p *Postgres) UpsertPage(url string) (int, error) {
+	return p.UpsertPageContext(context.Background(), url)
+}
+
+// GetPageContext returns the page node associated with the given id.
+func (p *Postgres) GetPageContext(ctx context.Context, id int) (*Page, error) {
 	var page Page
-	result := p.db.QueryRow(
-		`SELECT id, url, crawled_status
+	var fetchedAt sql.NullTime
+	var simhash int64
+	result := p.db.QueryRowContext(ctx,
+		`SELECT id, url, crawled_status, fetched_at, COALESCE(etag, ''), COALESCE(last_modified, ''),
+			COALESCE(media_type, ''), COALESCE(charset, ''), COALESCE(content_length, -1), noindex,
+			COALESCE(status_code, 0), COALESCE(canonical_url, ''), COALESCE(alias_of, 0),
+			COALESCE(content_hash, ''), COALESCE(simhash, 0), COALESCE(duplicate_of, 0)
 		FROM page_nodes
 		WHERE id = $1`, id)
-	err := result.Scan(&page.ID, &page.URL, &page.CrawledStatus)
+	err := result.Scan(&page.ID, &page.URL, &page.CrawledStatus, &fetchedAt, &page.ETag, &page.LastModified,
+		&page.MediaType, &page.Charset, &page.ContentLength, &page.NoIndex, &page.StatusCode, &page.CanonicalURL, &page.AliasOf,
+		&page.ContentHash, &simhash, &page.DuplicateOf)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get page %d: %v", id, err)
 	}
+	page.FetchedAt = fetchedAt.Time
+	// simhashes are stored as signed integers, since postgres has no unsigned
+	// ones
+	page.SimHash = uint64(simhash)
 	return &page, nil
 }
 
-// GetEdgesForPage returns all edges associated with a page where the given page
-// is the source node.
-func (p *Postgres) GetEdgesForPage(page *Page) ([]Edge, error) {
+// GetPage calls GetPageContext with a background context.
+func (p *Postgres) GetPage(id int) (*Page, error) {
+	return p.GetPageContext(context.Background(), id)
+}
+
+// GetEdgesForPageContext returns all edges associated with a page where the
+// given page is the source node.
+func (p *Postgres) GetEdgesForPageContext(ctx context.Context, page *Page) ([]Edge, error) {
 	var edges []Edge
-	rows, err := p.db.Query(
-		`SELECT id, source_id, target_id
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT id, source_id, target_id, kind, COALESCE(status_code, 0), COALESCE(rel, ''), COALESCE(merged_from, 0)
 		FROM edges
-		WHERE source_id = $1`, page.ID)
+		WHERE source_id = $1
+		ORDER BY id ASC`, page.ID)
 	if err != nil {
 		return edges, fmt.Errorf("Unable to retrieve edges for page %d: %v", page.ID, err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var id, sourceID, targetID int
-		if err := rows.Scan(&id, &sourceID, &targetID); err != nil {
+		var e Edge
+		if err := rows.Scan(&e.ID, &e.SourceID, &e.TargetID, &e.Kind, &e.StatusCode, &e.Rel, &e.MergedFrom); err != nil {
 			return edges, err
 		}
-		edges = append(edges, Edge{ID: id, SourceID: sourceID, TargetID: targetID})
+		edges = append(edges, e)
 	}
 	return edges, nil
 }
 
-// UpdatePageEdges adds new edges for a page node, creating new pages in the
-// process if necessary. It also updates the CrawledStatus of the given page
-// node to true.
-func (p *Postgres) UpdatePageEdges(pageID int, urls []string) error {
-	for _, url := range urls {
-		targetID, err := p.UpsertPage(url)
+// GetEdgesForPage calls GetEdgesForPageContext with a background context.
+func (p *Postgres) GetEdgesForPage(page *Page) ([]Edge, error) {
+	return p.GetEdgesForPageContext(context.Background(), page)
+}
+
+// UpdatePageEdgesContext replaces the edges of a page node with edges to the
+// pages the given links point to, creating new pages in the process if
+// necessary. Edges merged into the page node from its aliases are kept, unless
+// the page node now has the same edge itself, and so are sitemap edges. It also
+// updates the CrawledStatus of the given page node to true. The edges are
+// replaced in a single transaction, so the page node is never seen without
+// them.
+func (p *Postgres) UpdatePageEdgesContext(ctx context.Context, pageID int, links []Link) error {
+	// the pages the links point to are created up front, they don't need to
+	// be rolled back if the edges can't be replaced
+	targetIDs := make([]int, len(links))
+	for i, l := range links {
+		targetID, err := p.UpsertPageContext(ctx, l.URL)
 		if err != nil {
-			return fmt.Errorf("Could not upsert page with url %s during edge update: %v", url, err)
+			return fmt.Errorf("Could not upsert page with url %s during edge update: %v", l.URL, err)
 		}
-		if targetID != pageID {
-			// add edge to graph
-			_, err = p.db.Exec(
-				`INSERT INTO edges
-				(id, source_id, target_id)
-				VALUES (DEFAULT, $1, $2)
-				ON CONFLICT DO NOTHING`, pageID, targetID)
-			if err != nil {
-				fmt.Printf("Could not insert edge between source page %d and target page %d during edge update: %v", pageID, targetID, err)
-				continue
-			}
+		targetIDs[i] = targetID
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to begin transaction for page %d: %v", pageID, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM edges
+		WHERE source_id=$1 AND merged_from IS NULL AND kind != $2`, pageID, EdgeKindSitemap)
+	if err != nil {
+		return fmt.Errorf("Unable to delete edges for page %d: %v", pageID, err)
+	}
+	for i, l := range links {
+		if targetIDs[i] == pageID {
+			continue
+		}
+		// an edge merged from an alias becomes the page node's own edge once
+		// the page node links to the same page itself
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO edges
+			(id, source_id, target_id, kind, rel)
+			VALUES (DEFAULT, $1, $2, $3, NULLIF($4, ''))
+			ON CONFLICT (source_id, target_id, kind) DO UPDATE
+			SET rel=EXCLUDED.rel, status_code=NULL, merged_from=NULL`, pageID, targetIDs[i], l.Kind, l.Rel)
+		if err != nil {
+			return fmt.Errorf("Could not insert edge between source page %d and target page %d during edge update: %v", pageID, targetIDs[i], err)
 		}
 	}
 
 	// update crawled status of page to true
-	_, err := p.db.Exec(
+	_, err = tx.ExecContext(ctx,
 		`UPDATE page_nodes
 		SET crawled_status=$1
 		WHERE id=$2`, true, pageID)
 	if err != nil {
 		return fmt.Errorf("Unable to update page %d status to true: %v", pageID, err)
 	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Unable to update edges for page %d: %v", pageID, err)
+	}
+	return nil
+}
+
+// UpdatePageEdges calls UpdatePageEdgesContext with a background context.
+func (p *Postgres) UpdatePageEdges(pageID int, links []Link) error {
+	return p.UpdatePageEdgesContext(context.Background(), pageID, links)
+}
+
+// UpdateSitemapEdgesContext replaces the sitemap edges of a page node with
+// edges to the pages the given links point to, creating new pages in the
+// process if necessary.
+func (p *Postgres) UpdateSitemapEdgesContext(ctx context.Context, pageID int, links []Link) error {
+	_, err := p.db.ExecContext(ctx,
+		`DELETE FROM edges
+		WHERE source_id=$1 AND kind=$2`, pageID, EdgeKindSitemap)
+	if err != nil {
+		return fmt.Errorf("Unable to delete sitemap edges for page %d: %v", pageID, err)
+	}
+	for _, l := range links {
+		targetID, err := p.UpsertPageContext(ctx, l.URL)
+		if err != nil {
+			return fmt.Errorf("Could not upsert page with url %s during sitemap update: %v", l.URL, err)
+		}
+		if targetID == pageID {
+			continue
+		}
+		_, err = p.db.ExecContext(ctx,
+			`INSERT INTO edges
+			(id, source_id, target_id, kind)
+			VALUES (DEFAULT, $1, $2, $3)
+			ON CONFLICT DO NOTHING`, pageID, targetID, EdgeKindSitemap)
+		if err != nil {
+			fmt.Printf("Could not insert sitemap edge between source page %d and target page %d: %v", pageID, targetID, err)
+			continue
+		}
+	}
+	return nil
+}
+
+// UpdateSitemapEdges calls UpdateSitemapEdgesContext with a background context.
+func (p *Postgres) UpdateSitemapEdges(pageID int, links []Link) error {
+	return p.UpdateSitemapEdgesContext(context.Background(), pageID, links)
+}
+
+// AddRedirectEdgeContext records that the page node with the given id
+// redirected to the given url with the given status code, replacing any edges
+// the page node already had and creating a page node for the url if necessary.
+// It also updates the CrawledStatus, fetch time and status code of the
+// redirecting page node, and returns the id of the page node that was
+// redirected to.
+func (p *Postgres) AddRedirectEdgeContext(ctx context.Context, pageID int, url string, statusCode int) (int, error) {
+	targetID, err := p.UpsertPageContext(ctx, url)
+	if err != nil {
+		return targetID, fmt.Errorf("Could not upsert page with url %s during redirect update: %v", url, err)
+	}
+	err = p.deletePageEdges(ctx, pageID)
+	if err != nil {
+		return targetID, err
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO edges
+		(id, source_id, target_id, kind, status_code)
+		VALUES (DEFAULT, $1, $2, $3, $4)`, pageID, targetID, EdgeKindRedirect, statusCode)
+	if err != nil {
+		return targetID, fmt.Errorf("Could not insert redirect edge between source page %d and target page %d: %v", pageID, targetID, err)
+	}
+
+	_, err = p.db.ExecContext(ctx,
+		`UPDATE page_nodes
+		SET crawled_status=$1, fetched_at=now(), etag=NULL, last_modified=NULL, status_code=$3
+		WHERE id=$2`, true, pageID, statusCode)
+	if err != nil {
+		return targetID, fmt.Errorf("Unable to update page %d status to true: %v", pageID, err)
+	}
+	return targetID, nil
+}
+
+// AddRedirectEdge calls AddRedirectEdgeContext with a background context.
+func (p *Postgres) AddRedirectEdge(pageID int, url string, statusCode int) (int, error) {
+	return p.AddRedirectEdgeContext(context.Background(), pageID, url, statusCode)
+}
+
+// UpdatePageFetchContext records that a page node was just fetched, along with
+// the validators, media type, character set, content length, noindex flag,
+// status code, canonical url and content fingerprint it was fetched with.
+func (p *Postgres) UpdatePageFetchContext(ctx context.Context, page *Page) error {
+	_, err := p.db.ExecContext(ctx,
+		`UPDATE page_nodes
+		SET fetched_at=now(), etag=NULLIF($2, ''), last_modified=NULLIF($3, ''),
+			media_type=NULLIF($4, ''), content_length=NULLIF($5::bigint, -1), noindex=$6,
+			status_code=NULLIF($7, 0), canonical_url=NULLIF($8, ''), charset=NULLIF($9, ''),
+			content_hash=NULLIF($10, ''), simhash=CASE WHEN $10 = '' THEN NULL ELSE $11::bigint END,
+			duplicate_of=NULLIF($12, 0)
+		WHERE id=$1`, page.ID, page.ETag, page.LastModified, page.MediaType, page.ContentLength, page.NoIndex,
+		page.StatusCode, page.CanonicalURL, page.Charset, page.ContentHash, int64(page.SimHash), page.DuplicateOf)
+	if err != nil {
+		return fmt.Errorf("Unable to update fetch time of page %d: %v", page.ID, err)
+	}
+	return nil
+}
+
+// UpdatePageFetch calls UpdatePageFetchContext with a background context.
+func (p *Postgres) UpdatePageFetch(page *Page) error {
+	return p.UpdatePageFetchContext(context.Background(), page)
+}
+
+// UpdatePageMetadataContext replaces the metadata of a page node.
+func (p *Postgres) UpdatePageMetadataContext(ctx context.Context, pageID int, m *PageMetadata) error {
+	h1s, err := json.Marshal(m.H1s)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal headings of page %d: %v", pageID, err)
+	}
+	openGraph, err := json.Marshal(m.OpenGraph)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal OpenGraph fields of page %d: %v", pageID, err)
+	}
+	twitter, err := json.Marshal(m.Twitter)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal Twitter card fields of page %d: %v", pageID, err)
+	}
+	_, err = p.db.ExecContext(ctx,
+		`INSERT INTO page_metadata
+		(page_id, title, description, lang, h1s, word_count, open_graph, twitter)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), COALESCE($5::jsonb, '[]'), $6,
+			COALESCE($7::jsonb, '{}'), COALESCE($8::jsonb, '{}'))
+		ON CONFLICT (page_id) DO UPDATE
+		SET title=EXCLUDED.title, description=EXCLUDED.description, lang=EXCLUDED.lang, h1s=EXCLUDED.h1s,
+			word_count=EXCLUDED.word_count, open_graph=EXCLUDED.open_graph, twitter=EXCLUDED.twitter`,
+		pageID, m.Title, m.Description, m.Lang, nullJSON(h1s), m.WordCount, nullJSON(openGraph), nullJSON(twitter))
+	if err != nil {
+		return fmt.Errorf("Unable to update metadata of page %d: %v", pageID, err)
+	}
+	return nil
+}
+
+// UpdatePageMetadata calls UpdatePageMetadataContext with a background context.
+func (p *Postgres) UpdatePageMetadata(pageID int, m *PageMetadata) error {
+	return p.UpdatePageMetadataContext(context.Background(), pageID, m)
+}
+
+// GetPageMetadataContext returns the metadata of a page node, which is empty if
+// the page node isn't an html page that has been crawled.
+func (p *Postgres) GetPageMetadataContext(ctx context.Context, pageID int) (*PageMetadata, error) {
+	m := PageMetadata{H1s: []string{}, OpenGraph: map[string]string{}, Twitter: map[string]string{}}
+	var h1s, openGraph, twitter string
+	result := p.db.QueryRowContext(ctx,
+		`SELECT COALESCE(title, ''), COALESCE(description, ''), COALESCE(lang, ''), h1s::text, word_count,
+			open_graph::text, twitter::text
+		FROM page_metadata
+		WHERE page_id = $1`, pageID)
+	err := result.Scan(&m.Title, &m.Description, &m.Lang, &h1s, &m.WordCount, &openGraph, &twitter)
+	if err == sql.ErrNoRows {
+		return &m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to get metadata of page %d: %v", pageID, err)
+	}
+	for _, v := range []struct {
+		raw string
+		dst interface{}
+	}{{h1s, &m.H1s}, {openGraph, &m.OpenGraph}, {twitter, &m.Twitter}} {
+		if err := json.Unmarshal([]byte(v.raw), v.dst); err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal metadata of page %d: %v", pageID, err)
+		}
+	}
+	return &m, nil
+}
+
+// GetPageMetadata calls GetPageMetadataContext with a background context.
+func (p *Postgres) GetPageMetadata(pageID int) (*PageMetadata, error) {
+	return p.GetPageMetadataContext(context.Background(), pageID)
+}
+
+// nullJSON turns the JSON null that nil slices and maps marshal to into an
+// sql NULL, so that column defaults can be used instead.
+func nullJSON(b []byte) interface{} {
+	if string(b) == "null" {
+		return nil
+	}
+	return string(b)
+}
+
+// UpdatePageStatusContext records the http status code a page node responded
+// with when it couldn't be crawled.
+func (p *Postgres) UpdatePageStatusContext(ctx context.Context, pageID int, statusCode int) error {
+	_, err := p.db.ExecContext(ctx,
+		`UPDATE page_nodes
+		SET status_code=$2
+		WHERE id=$1`, pageID, statusCode)
+	if err != nil {
+		return fmt.Errorf("Unable to update status code of page %d: %v", pageID, err)
+	}
+	return nil
+}
+
+// UpdatePageStatus calls UpdatePageStatusContext with a background context.
+func (p *Postgres) UpdatePageStatus(pageID int, statusCode int) error {
+	return p.UpdatePageStatusContext(context.Background(), pageID, statusCode)
+}
+
+// MergeAliasContext records that the page node with the given alias id is an
+// alias of the page node with the given canonical id, and copies the alias's
+// edges to the canonical page node, skipping edges the canonical page node
+// already has. Any edges previously merged from the alias are replaced.
+func (p *Postgres) MergeAliasContext(ctx context.Context, aliasID, canonicalID int) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to begin transaction for alias %d: %v", aliasID, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`DELETE FROM edges
+		WHERE merged_from=$1`, aliasID)
+	if err != nil {
+		return fmt.Errorf("Unable to delete edges merged from page %d: %v", aliasID, err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO edges
+		(source_id, target_id, kind, status_code, rel, merged_from)
+		SELECT $2::integer, e.target_id, e.kind, e.status_code, e.rel, $1::integer
+		FROM edges e
+		WHERE e.source_id=$1 AND e.merged_from IS NULL AND e.target_id != $2
+		AND NOT EXISTS (SELECT 1 FROM edges o
+			WHERE o.source_id=$2 AND o.target_id=e.target_id AND o.kind=e.kind)
+		ON CONFLICT DO NOTHING`, aliasID, canonicalID)
+	if err != nil {
+		return fmt.Errorf("Unable to merge edges of page %d into page %d: %v", aliasID, canonicalID, err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE page_nodes
+		SET alias_of=$2
+		WHERE id=$1`, aliasID, canonicalID)
+	if err != nil {
+		return fmt.Errorf("Unable to make page %d an alias of page %d: %v", aliasID, canonicalID, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Unable to merge alias %d: %v", aliasID, err)
+	}
+	return nil
+}
+
+// MergeAlias calls MergeAliasContext with a background context.
+func (p *Postgres) MergeAlias(aliasID, canonicalID int) error {
+	return p.MergeAliasContext(context.Background(), aliasID, canonicalID)
+}
+
+// UnmergeAliasContext undoes MergeAlias for a page node that is no longer an
+// alias, removing the edges that were merged from it.
+func (p *Postgres) UnmergeAliasContext(ctx context.Context, aliasID int) error {
+	_, err := p.db.ExecContext(ctx,
+		`DELETE FROM edges
+		WHERE merged_from=$1`, aliasID)
+	if err != nil {
+		return fmt.Errorf("Unable to delete edges merged from page %d: %v", aliasID, err)
+	}
+	_, err = p.db.ExecContext(ctx,
+		`UPDATE page_nodes
+		SET alias_of=NULL
+		WHERE id=$1`, aliasID)
+	if err != nil {
+		return fmt.Errorf("Unable to update alias of page %d: %v", aliasID, err)
+	}
+	return nil
+}
+
+// UnmergeAlias calls UnmergeAliasContext with a background context.
+func (p *Postgres) UnmergeAlias(aliasID int) error {
+	return p.UnmergeAliasContext(context.Background(), aliasID)
+}
+
+// deletePageEdges removes all edges where the given page node is the source
+// node.
+func (p *Postgres) deletePageEdges(ctx context.Context, pageID int) error {
+	_, err := p.db.ExecContext(ctx,
+		`DELETE FROM edges
+		WHERE source_id=$1`, pageID)
+	if err != nil {
+		return fmt.Errorf("Unable to delete edges for page %d: %v", pageID, err)
+	}
 	return nil
 }
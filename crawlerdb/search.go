@@ -0,0 +1,109 @@
+package crawlerdb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// searchConfig is the postgres text search configuration pages are
+	// indexed and searched with.
+	searchConfig = "english"
+	// maxContentText is the maximum number of bytes of a page's text that are
+	// stored and indexed, which keeps search vectors well below postgres's
+	// limit of 1MB.
+	maxContentText = 256 << 10
+)
+
+// UpdatePageContentContext replaces the visible text of a page node, and
+// indexes it for full-text search along with the page's metadata, which is
+// weighted above the rest of the text. A page node without any text is removed
+// from the index.
+func (p *Postgres) UpdatePageContentContext(ctx context.Context, pageID int, text string, m *PageMetadata) error {
+	if text == "" {
+		_, err := p.db.ExecContext(ctx,
+			`DELETE FROM page_contents
+			WHERE page_id = $1`, pageID)
+		if err != nil {
+			return fmt.Errorf("Unable to delete content of page %d: %v", pageID, err)
+		}
+		return nil
+	}
+	if len(text) > maxContentText {
+		// cut at a rune boundary, so that the text stays valid utf-8
+		i := maxContentText
+		for i > 0 && !utf8.RuneStart(text[i]) {
+			i--
+		}
+		text = text[:i]
+	}
+	_, err := p.db.ExecContext(ctx,
+		`INSERT INTO page_contents
+		(page_id, content_text, search_vector)
+		VALUES ($1, $2::text,
+			setweight(to_tsvector($6::regconfig, $3::text), 'A') ||
+			setweight(to_tsvector($6::regconfig, $4::text), 'B') ||
+			setweight(to_tsvector($6::regconfig, $5::text), 'C') ||
+			setweight(to_tsvector($6::regconfig, $2::text), 'D'))
+		ON CONFLICT (page_id) DO UPDATE
+		SET content_text=EXCLUDED.content_text, search_vector=EXCLUDED.search_vector`,
+		pageID, text, m.Title, strings.Join(m.H1s, " "), m.Description, searchConfig)
+	if err != nil {
+		return fmt.Errorf("Unable to update content of page %d: %v", pageID, err)
+	}
+	return nil
+}
+
+// UpdatePageContent calls UpdatePageContentContext with a background context.
+func (p *Postgres) UpdatePageContent(pageID int, text string, m *PageMetadata) error {
+	return p.UpdatePageContentContext(context.Background(), pageID, text, m)
+}
+
+// SearchPagesContext returns the pages whose text matches a web search style
+// query (such as `"red shoes" -boots`), best matches first, skipping the first
+// offset matches and returning at most limit of them. If crawlRequestID isn't
+// 0, only pages crawled during that crawl request are searched. Pages that
+// asked not to be indexed are left out.
+func (p *Postgres) SearchPagesContext(ctx context.Context, query string, crawlRequestID, limit, offset int) ([]*SearchResult, error) {
+	var results []*SearchResult
+	// snippets are only generated for the page of results, since that's the
+	// expensive part
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT r.id, r.url, r.title, r.rank,
+			ts_headline($5::regconfig, c.content_text, websearch_to_tsquery($5::regconfig, $1),
+				'StartSel=<b>, StopSel=</b>, MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" ... "')
+		FROM (
+			SELECT p.id, p.url, COALESCE(m.title, '') AS title,
+				ts_rank_cd(c.search_vector, websearch_to_tsquery($5::regconfig, $1)) AS rank
+			FROM page_contents c
+			JOIN page_nodes p ON p.id = c.page_id
+			LEFT JOIN page_metadata m ON m.page_id = c.page_id
+			WHERE c.search_vector @@ websearch_to_tsquery($5::regconfig, $1) AND NOT p.noindex
+			AND ($2 = 0 OR EXISTS (SELECT 1 FROM tasks t
+				WHERE t.crawl_request_id = $2 AND (t.page_url = p.url OR t.final_url = p.url)))
+			ORDER BY rank DESC, p.id
+			LIMIT $3 OFFSET $4
+		) r
+		JOIN page_contents c ON c.page_id = r.id
+		ORDER BY r.rank DESC, r.id`, query, crawlRequestID, limit, offset, searchConfig)
+	if err != nil {
+		return results, fmt.Errorf("Unable to search pages for %q: %v", query, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := SearchResult{}
+		if err := rows.Scan(&r.PageID, &r.URL, &r.Title, &r.Rank, &r.Snippet); err != nil {
+			return results, fmt.Errorf("Unable to scan search results for %q: %v", query, err)
+		}
+		results = append(results, &r)
+	}
+	return results, nil
+}
+
+// SearchPages calls SearchPagesContext with a background context.
+func (p *Postgres) SearchPages(query string, crawlRequestID, limit, offset int) ([]*SearchResult, error) {
+	return p.SearchPagesContext(context.Background(), query, crawlRequestID, limit, offset)
+}
@@ -1,19 +1,32 @@
 package crawlerdb
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 )
 
 var (
 	ErrNoTasksAvailable = errors.New("no tasks available right now")
 	ErrDoesNotExist     = errors.New("sql: no rows in result set")
+	ErrHostOverBudget   = errors.New("host has no request budget available right now")
+	ErrLeaseLost        = errors.New("task lease is no longer held by this worker")
 )
 
-// CreateTask creates a new task.
-func (p *Postgres) CreateTask(crawlRequestID int, url string, currLevel int, seen bool) error {
-	_, err := p.db.Exec(
+// taskBatchSize is the number of tasks CreateTasks inserts per statement,
+// which keeps the number of parameters well under Postgres' limit of 65535.
+const taskBatchSize = 1000
+
+// CreateTaskContext creates a new task for the canonical form of the given url.
+func (p *Postgres) CreateTaskContext(ctx context.Context, crawlRequestID int, url string, currLevel int, seen bool) error {
+	url, err := p.canon.Canonicalize(url)
+	if err != nil {
+		return fmt.Errorf("Unable to create task: %v", err)
+	}
+	_, err = p.db.ExecContext(ctx,
 		`INSERT INTO tasks
 		(id, crawl_request_id, page_url, current_level, status, seen_url)
 		VALUES (DEFAULT, $1, $2, $3, $4, $5)`, crawlRequestID, url, currLevel, "NOT_STARTED", seen)
@@ -23,37 +36,397 @@ func (p *Postgres) CreateTask(crawlRequestID int, url string, currLevel int, see
 	return nil
 }
 
-// UpdateTaskStatus updates the status of a task.
-func (p *Postgres) UpdateTaskStatus(id int, status string) error {
-	_, err := p.db.Exec(
+// CreateTask calls CreateTaskContext with a background context.
+func (p *Postgres) CreateTask(crawlRequestID int, url string, currLevel int, seen bool) error {
+	return p.CreateTaskContext(context.Background(), crawlRequestID, url, currLevel, seen)
+}
+
+// CreateTasksContext creates a task for the canonical form of the page url of
+// each of the given tasks, at their crawl request, level and seen flag, using
+// as few statements as possible. A task that would crawl a url its crawl
+// request already has a task crawling is skipped, which only happens when two
+// workers add the same url at the same time.
+func (p *Postgres) CreateTasksContext(ctx context.Context, tasks []*Task) error {
+	for len(tasks) > 0 {
+		n := len(tasks)
+		if n > taskBatchSize {
+			n = taskBatchSize
+		}
+		values := make([]string, n)
+		args := []interface{}{"NOT_STARTED"}
+		for i, t := range tasks[:n] {
+			url, err := p.canon.Canonicalize(t.PageURL)
+			if err != nil {
+				return fmt.Errorf("Unable to create task: %v", err)
+			}
+			j := len(args)
+			values[i] = fmt.Sprintf("(DEFAULT, $%d, $%d, $%d, $1, $%d)", j+1, j+2, j+3, j+4)
+			args = append(args, t.CrawlRequestID, url, t.CurrentLevel, t.SeenURL)
+		}
+		_, err := p.db.ExecContext(ctx,
+			`INSERT INTO tasks
+			(id, crawl_request_id, page_url, current_level, status, seen_url)
+			VALUES `+strings.Join(values, ", ")+`
+			ON CONFLICT DO NOTHING`, args...)
+		if err != nil {
+			return fmt.Errorf("Unable to create tasks: %v", err)
+		}
+		tasks = tasks[n:]
+	}
+	return nil
+}
+
+// CreateTasks calls CreateTasksContext with a background context.
+func (p *Postgres) CreateTasks(tasks []*Task) error {
+	return p.CreateTasksContext(context.Background(), tasks)
+}
+
+// leasedUpdate checks the result of an update of an in progress task that is
+// only made if the given worker holds its lease, returning ErrLeaseLost if it
+// didn't.
+func leasedUpdate(result sql.Result, err error, action string) error {
+	if err != nil {
+		return fmt.Errorf("Unable to %s: %v", action, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Unable to %s: %v", action, err)
+	}
+	if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// UpdateTaskStatusContext updates the status of a task leased to the given
+// worker, releasing its lease. It returns ErrLeaseLost if the worker no longer
+// holds the lease.
+func (p *Postgres) UpdateTaskStatusContext(ctx context.Context, id int, workerID string, status string) error {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE tasks
+		SET status = $2, claimed_by = NULL, lease_expires_at = NULL
+		WHERE id = $1 AND status = $3 AND claimed_by = $4`, id, status, "IN_PROGRESS", workerID)
+	return leasedUpdate(result, err, "update task")
+}
+
+// UpdateTaskStatus calls UpdateTaskStatusContext with a background context.
+func (p *Postgres) UpdateTaskStatus(id int, workerID string, status string) error {
+	return p.UpdateTaskStatusContext(context.Background(), id, workerID, status)
+}
+
+// UpdateTaskFinalURLContext records the url a task leased to the given worker
+// ended up crawling after following redirects. It returns ErrLeaseLost if the
+// worker no longer holds the lease.
+func (p *Postgres) UpdateTaskFinalURLContext(ctx context.Context, id int, workerID string, url string) error {
+	result, err := p.db.ExecContext(ctx,
 		`UPDATE tasks
-		SET status = $2
-		WHERE id = $1`, id, status)
+		SET final_url = $2
+		WHERE id = $1 AND status = $3 AND claimed_by = $4`, id, url, "IN_PROGRESS", workerID)
+	return leasedUpdate(result, err, "update task")
+}
+
+// UpdateTaskFinalURL calls UpdateTaskFinalURLContext with a background context.
+func (p *Postgres) UpdateTaskFinalURL(id int, workerID string, url string) error {
+	return p.UpdateTaskFinalURLContext(context.Background(), id, workerID, url)
+}
+
+// LinksAddedForURLContext reports whether a task of the crawl request, other
+// than the task with the given id, already ended up at the page with the given
+// url and added tasks for its links.
+func (p *Postgres) LinksAddedForURLContext(ctx context.Context, crawlRequestID, taskID int, url string) (bool, error) {
+	var added bool
+	result := p.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM tasks
+			WHERE crawl_request_id = $1 AND id != $2 AND status = $3 AND NOT seen_url
+			AND COALESCE(final_url, page_url) = $4
+			AND current_level < (SELECT levels FROM crawl_requests WHERE id = $1))`, crawlRequestID, taskID, "COMPLETED", url)
+	err := result.Scan(&added)
 	if err != nil {
-		return fmt.Errorf("Unable to update task: %v", err)
+		return added, fmt.Errorf("Unable to check tasks for url %s: %v", url, err)
 	}
-	return err
+	return added, nil
+}
+
+// LinksAddedForURL calls LinksAddedForURLContext with a background context.
+func (p *Postgres) LinksAddedForURL(crawlRequestID, taskID int, url string) (bool, error) {
+	return p.LinksAddedForURLContext(context.Background(), crawlRequestID, taskID, url)
+}
+
+// DeferTaskContext puts a task leased to the given worker back into the
+// "NOT_STARTED" state (or the "RETRYING" state if an earlier attempt of it
+// failed), releasing its lease, and makes sure it isn't picked up again until
+// the given time. Deferring a task doesn't count as an attempt. It returns
+// ErrLeaseLost if the worker no longer holds the lease.
+func (p *Postgres) DeferTaskContext(ctx context.Context, id int, workerID string, until time.Time) error {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE tasks
+		SET status = CASE WHEN attempts > 0 THEN $3 ELSE $2 END, eligible_at = $4,
+			claimed_by = NULL, lease_expires_at = NULL
+		WHERE id = $1 AND status = $5 AND claimed_by = $6`, id, "NOT_STARTED", "RETRYING", until, "IN_PROGRESS", workerID)
+	return leasedUpdate(result, err, "defer task")
+}
+
+// DeferTask calls DeferTaskContext with a background context.
+func (p *Postgres) DeferTask(id int, workerID string, until time.Time) error {
+	return p.DeferTaskContext(context.Background(), id, workerID, until)
+}
+
+// RetryTaskContext records a failed attempt of a task leased to the given
+// worker along with its error, releases its lease, and puts the task into the
+// "RETRYING" state until the given time, after which it is picked up again. It
+// returns ErrLeaseLost if the worker no longer holds the lease.
+func (p *Postgres) RetryTaskContext(ctx context.Context, id int, workerID string, lastError string, until time.Time) error {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE tasks
+		SET status = $2, attempts = attempts + 1, last_error = $3, eligible_at = $4,
+			claimed_by = NULL, lease_expires_at = NULL
+		WHERE id = $1 AND status = $5 AND claimed_by = $6`, id, "RETRYING", lastError, until, "IN_PROGRESS", workerID)
+	return leasedUpdate(result, err, "retry task")
+}
+
+// RetryTask calls RetryTaskContext with a background context.
+func (p *Postgres) RetryTask(id int, workerID string, lastError string, until time.Time) error {
+	return p.RetryTaskContext(context.Background(), id, workerID, lastError, until)
 }
 
-// FindIncompleteTask finds and returns the first task (sorted by
-// crawl_request_id ascending) that has not been started yet. It also updates
-// the task status to "IN_PROGRESS".
-func (p *Postgres) FindIncompleteTask() (*Task, error) {
-	var t Task
-	result := p.db.QueryRow(
+// FailTaskContext records the last failed attempt of a task leased to the
+// given worker along with its error, releases its lease, and marks the task as
+// "FAILED". It returns ErrLeaseLost if the worker no longer holds the lease.
+func (p *Postgres) FailTaskContext(ctx context.Context, id int, workerID string, lastError string) error {
+	result, err := p.db.ExecContext(ctx,
 		`UPDATE tasks
-		SET status = $1
-		WHERE id = (SELECT id FROM tasks
-			WHERE status=$2
-			ORDER BY crawl_request_id ASC
-			LIMIT 1)
-		RETURNING id, crawl_request_id, page_url, current_level, status, seen_url`, "IN_PROGRESS", "NOT_STARTED")
-	err := result.Scan(&t.ID, &t.CrawlRequestID, &t.PageURL, &t.CurrentLevel, &t.Status, &t.SeenURL)
-	if err == sql.ErrNoRows {
+		SET status = $2, attempts = attempts + 1, last_error = $3,
+			claimed_by = NULL, lease_expires_at = NULL
+		WHERE id = $1 AND status = $4 AND claimed_by = $5`, id, "FAILED", lastError, "IN_PROGRESS", workerID)
+	return leasedUpdate(result, err, "fail task")
+}
+
+// FailTask calls FailTaskContext with a background context.
+func (p *Postgres) FailTask(id int, workerID string, lastError string) error {
+	return p.FailTaskContext(context.Background(), id, workerID, lastError)
+}
+
+// ClaimTasksContext claims up to n tasks that have not been started yet or are
+// waiting to be retried, and aren't deferred. It updates their status to
+// "IN_PROGRESS", leases them to the given worker for the given amount of time,
+// and returns them. It returns an empty slice if there are no tasks to claim
+// right now.
+//
+// The tasks are taken from the crawl request with the highest priority that
+// has tasks waiting. Crawl requests with the same priority share the workers
+// in proportion to their weight: every claimed task advances its crawl
+// request's virtual time by 1/weight, and the crawl request that is furthest
+// behind goes next. Within a crawl request, tasks are claimed in the order they
+// were created. If the crawl request doesn't have n tasks left to claim, the
+// rest of the tasks are taken from the next crawl request in line, and so on.
+//
+// Tasks are locked with FOR UPDATE SKIP LOCKED, so crawlers claiming tasks at
+// the same time get different tasks instead of waiting on each other, and a
+// crawler whose first choice of crawl request only has tasks that another
+// crawler is claiming moves on to the next one. The virtual time of a crawl
+// request is advanced in a statement of its own once its tasks are claimed, so
+// that its row is only locked for as long as that takes.
+func (p *Postgres) ClaimTasksContext(ctx context.Context, workerID string, lease time.Duration, n int) ([]*Task, error) {
+	var tasks []*Task
+	requests, err := p.claimableCrawlRequests(ctx)
+	if err != nil {
+		return tasks, err
+	}
+	for _, id := range requests {
+		if len(tasks) >= n {
+			break
+		}
+		claimed, err := p.claimCrawlRequestTasks(ctx, id, workerID, lease, n-len(tasks))
+		tasks = append(tasks, claimed...)
+		if err != nil {
+			return tasks, err
+		}
+	}
+	return tasks, nil
+}
+
+// ClaimTasks calls ClaimTasksContext with a background context.
+func (p *Postgres) ClaimTasks(workerID string, lease time.Duration, n int) ([]*Task, error) {
+	return p.ClaimTasksContext(context.Background(), workerID, lease, n)
+}
+
+// claimableCrawlRequests returns the ids of the crawl requests that have tasks
+// waiting to be claimed, in the order they should be served.
+func (p *Postgres) claimableCrawlRequests(ctx context.Context) ([]int, error) {
+	var ids []int
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT cr.id FROM crawl_requests cr
+		WHERE EXISTS (SELECT 1 FROM tasks t
+			WHERE t.crawl_request_id = cr.id AND t.status IN ($1, $2) AND t.eligible_at <= now())
+		ORDER BY cr.priority DESC, cr.virtual_time ASC, cr.id ASC`, "NOT_STARTED", "RETRYING")
+	if err != nil {
+		return ids, fmt.Errorf("Unable to find crawl requests with tasks waiting: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, fmt.Errorf("Unable to scan crawl requests with tasks waiting: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return ids, fmt.Errorf("Unable to find crawl requests with tasks waiting: %v", err)
+	}
+	return ids, nil
+}
+
+// claimCrawlRequestTasks claims up to n of the tasks of a crawl request that
+// aren't locked by another crawler, and advances the crawl request's virtual
+// time by the number of claimed tasks.
+func (p *Postgres) claimCrawlRequestTasks(ctx context.Context, crawlRequestID int, workerID string, lease time.Duration, n int) ([]*Task, error) {
+	var tasks []*Task
+	rows, err := p.db.QueryContext(ctx,
+		`WITH next_tasks AS (
+			SELECT t.id FROM tasks t
+			WHERE t.crawl_request_id = $6 AND t.status IN ($2, $3) AND t.eligible_at <= now()
+			ORDER BY t.id ASC
+			LIMIT $7
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE tasks
+			SET status = $1, claimed_by = $4, lease_expires_at = now() + $5::float8 * interval '1 second'
+			WHERE id IN (SELECT id FROM next_tasks)
+			RETURNING id, crawl_request_id, page_url, current_level, status, seen_url, attempts, last_error,
+				claimed_by, lease_expires_at
+		)
+		SELECT id, crawl_request_id, page_url, current_level, status, seen_url, attempts, COALESCE(last_error, ''),
+			claimed_by, lease_expires_at
+		FROM claimed
+		ORDER BY id ASC`,
+		"IN_PROGRESS", "NOT_STARTED", "RETRYING", workerID, lease.Seconds(), crawlRequestID, n)
+	if err != nil {
+		return tasks, fmt.Errorf("Could not claim tasks of crawl request with id %d: %v", crawlRequestID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Task{}
+		if err := rows.Scan(&t.ID, &t.CrawlRequestID, &t.PageURL, &t.CurrentLevel, &t.Status, &t.SeenURL, &t.Attempts, &t.LastError,
+			&t.ClaimedBy, &t.LeaseExpiresAt); err != nil {
+			return tasks, fmt.Errorf("Unable to scan claimed tasks of crawl request with id %d: %v", crawlRequestID, err)
+		}
+		tasks = append(tasks, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return tasks, fmt.Errorf("Could not claim tasks of crawl request with id %d: %v", crawlRequestID, err)
+	}
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+
+	_, err = p.db.ExecContext(ctx,
+		`UPDATE crawl_requests
+		SET virtual_time = virtual_time + $2::float8 / weight
+		WHERE id = $1`, crawlRequestID, len(tasks))
+	if err != nil {
+		return tasks, fmt.Errorf("Unable to update virtual time of crawl request with id %d: %v", crawlRequestID, err)
+	}
+	return tasks, nil
+}
+
+// FindIncompleteTaskContext claims the next task the same way as
+// ClaimTasksContext, and returns ErrNoTasksAvailable if there is none.
+func (p *Postgres) FindIncompleteTaskContext(ctx context.Context, workerID string, lease time.Duration) (*Task, error) {
+	tasks, err := p.ClaimTasksContext(ctx, workerID, lease, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
 		return nil, ErrNoTasksAvailable
 	}
+	return tasks[0], nil
+}
+
+// FindIncompleteTask calls FindIncompleteTaskContext with a background context.
+func (p *Postgres) FindIncompleteTask(workerID string, lease time.Duration) (*Task, error) {
+	return p.FindIncompleteTaskContext(context.Background(), workerID, lease)
+}
+
+// ExtendTaskLeaseContext extends the lease a worker holds on an in progress
+// task, so that it expires the given amount of time from now. It returns
+// ErrLeaseLost if the worker no longer holds the lease, because it expired and
+// the task was recovered.
+func (p *Postgres) ExtendTaskLeaseContext(ctx context.Context, id int, workerID string, lease time.Duration) error {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE tasks
+		SET lease_expires_at = now() + $4::float8 * interval '1 second'
+		WHERE id = $1 AND status = $2 AND claimed_by = $3`, id, "IN_PROGRESS", workerID, lease.Seconds())
+	if err != nil {
+		return fmt.Errorf("Unable to extend lease of task %d: %v", id, err)
+	}
+	n, err := result.RowsAffected()
 	if err != nil {
-		return nil, fmt.Errorf("Could not retrieve next task: %v", err)
+		return fmt.Errorf("Unable to extend lease of task %d: %v", id, err)
+	}
+	if n == 0 {
+		return ErrLeaseLost
 	}
-	return &t, nil
+	return nil
+}
+
+// ExtendTaskLease calls ExtendTaskLeaseContext with a background context.
+func (p *Postgres) ExtendTaskLease(id int, workerID string, lease time.Duration) error {
+	return p.ExtendTaskLeaseContext(context.Background(), id, workerID, lease)
+}
+
+// ReleaseTasksContext returns every in progress task leased to the given worker
+// to the "NOT_STARTED" state (or the "RETRYING" state if an earlier attempt of
+// it failed), so that another worker can pick it up right away. Releasing a
+// task doesn't count as an attempt. It returns the number of released tasks.
+func (p *Postgres) ReleaseTasksContext(ctx context.Context, workerID string) (int, error) {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE tasks
+		SET status = CASE WHEN attempts > 0 THEN $4 ELSE $3 END, eligible_at = now(),
+			claimed_by = NULL, lease_expires_at = NULL
+		WHERE status = $1 AND claimed_by = $2`, "IN_PROGRESS", workerID, "NOT_STARTED", "RETRYING")
+	if err != nil {
+		return 0, fmt.Errorf("Unable to release tasks of worker %s: %v", workerID, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to release tasks of worker %s: %v", workerID, err)
+	}
+	return int(n), nil
+}
+
+// ReleaseTasks calls ReleaseTasksContext with a background context.
+func (p *Postgres) ReleaseTasks(workerID string) (int, error) {
+	return p.ReleaseTasksContext(context.Background(), workerID)
+}
+
+// RecoverExpiredTasksContext returns in progress tasks whose lease expired,
+// because the worker holding it died or lost its connection to the database, to
+// the "RETRYING" state so that any worker can pick them up again. Recovering
+// a task counts as a failed attempt, and tasks that have had maxAttempts
+// attempts are marked as "FAILED" instead. It returns the number of recovered
+// tasks. It is safe to call from any number of crawlers at the same time.
+func (p *Postgres) RecoverExpiredTasksContext(ctx context.Context, maxAttempts int) (int, error) {
+	result, err := p.db.ExecContext(ctx,
+		`UPDATE tasks
+		SET status = CASE WHEN attempts + 1 >= $3 THEN $4 ELSE $2 END,
+			attempts = attempts + 1,
+			last_error = 'Lease of worker ' || claimed_by || ' expired',
+			eligible_at = now(), claimed_by = NULL, lease_expires_at = NULL
+		WHERE status = $1 AND lease_expires_at < now()`, "IN_PROGRESS", "RETRYING", maxAttempts, "FAILED")
+	if err != nil {
+		return 0, fmt.Errorf("Unable to recover expired tasks: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to recover expired tasks: %v", err)
+	}
+	return int(n), nil
+}
+
+// RecoverExpiredTasks calls RecoverExpiredTasksContext with a background
+// context.
+func (p *Postgres) RecoverExpiredTasks(maxAttempts int) (int, error) {
+	return p.RecoverExpiredTasksContext(context.Background(), maxAttempts)
 }
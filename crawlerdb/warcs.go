@@ -0,0 +1,57 @@
+package crawlerdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// AddWARCRecordsContext records where the given WARC records written for a
+// crawl request are stored.
+func (p *Postgres) AddWARCRecordsContext(ctx context.Context, records []*WARCRecord) error {
+	for _, r := range records {
+		_, err := p.db.ExecContext(ctx,
+			`INSERT INTO warc_records
+			(id, crawl_request_id, record_id, record_type, target_uri, filename, record_offset, record_length)
+			VALUES (DEFAULT, $1, $2, $3, $4, $5, $6, $7)`,
+			r.CrawlRequestID, r.RecordID, r.Type, r.TargetURI, r.Filename, r.Offset, r.Length)
+		if err != nil {
+			return fmt.Errorf("Unable to record WARC record %s: %v", r.RecordID, err)
+		}
+	}
+	return nil
+}
+
+// AddWARCRecords calls AddWARCRecordsContext with a background context.
+func (p *Postgres) AddWARCRecords(records []*WARCRecord) error {
+	return p.AddWARCRecordsContext(context.Background(), records)
+}
+
+// GetWARCRecordsContext returns every WARC record written for a crawl request,
+// in the order they appear in their WARC files.
+func (p *Postgres) GetWARCRecordsContext(ctx context.Context, crawlRequestID int) ([]*WARCRecord, error) {
+	var records []*WARCRecord
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT id, crawl_request_id, record_id, record_type, target_uri, filename, record_offset, record_length, created_at
+		FROM warc_records
+		WHERE crawl_request_id = $1
+		ORDER BY filename, record_offset`, crawlRequestID)
+	if err != nil {
+		return records, fmt.Errorf("Unable to get WARC records for crawl request with id %d: %v", crawlRequestID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := WARCRecord{}
+		if err := rows.Scan(&r.ID, &r.CrawlRequestID, &r.RecordID, &r.Type, &r.TargetURI, &r.Filename,
+			&r.Offset, &r.Length, &r.CreatedAt); err != nil {
+			return records, fmt.Errorf("Unable to scan WARC records for crawl request with id %d: %v", crawlRequestID, err)
+		}
+		records = append(records, &r)
+	}
+	return records, nil
+}
+
+// GetWARCRecords calls GetWARCRecordsContext with a background context.
+func (p *Postgres) GetWARCRecords(crawlRequestID int) ([]*WARCRecord, error) {
+	return p.GetWARCRecordsContext(context.Background(), crawlRequestID)
+}
@@ -0,0 +1,178 @@
+package graphcrawler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/warc"
+)
+
+// archiveKey is the context key marking requests whose exchanges are written
+// to WARC files. Its value is the url of the page that redirected to the
+// request's url, if any.
+type archiveKey struct{}
+
+// withArchive returns a copy of ctx, under which the exchanges of requests are
+// written to WARC files. via is the url of the page that redirected to the
+// request's url, or empty if there is none.
+func withArchive(ctx context.Context, via string) context.Context {
+	return context.WithValue(ctx, archiveKey{}, via)
+}
+
+// archivingFetcher wraps a Fetcher, writing the exchanges of requests made
+// under withArchive to WARC files once their response body is closed, and
+// recording where their records were written to in the database. Requests
+// that fail without a response aren't archived.
+type archivingFetcher struct {
+	Fetcher
+	db    store
+	warcs *warc.Writer
+}
+
+// Do sends a request using the wrapped Fetcher, archiving it if necessary.
+func (f *archivingFetcher) Do(req *http.Request) (*http.Response, error) {
+	via, ok := req.Context().Value(archiveKey{}).(string)
+	if !ok || f.warcs == nil {
+		return f.Fetcher.Do(req)
+	}
+	var mu sync.Mutex
+	var ip string
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				mu.Lock()
+				ip = addr.IP.String()
+				mu.Unlock()
+			}
+		},
+	}))
+	date := time.Now()
+	resp, err := f.Fetcher.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	crawlRequestID, _ := req.Context().Value(crawlRequestKey{}).(int)
+	resp.Body = &archivedBody{ReadCloser: resp.Body, size: resp.ContentLength, write: func(body []byte, truncated bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		f.archive(crawlRequestID, req, resp, body, truncated, via, ip, date)
+	}}
+	return resp, nil
+}
+
+// archive writes the request, response and metadata records of a single
+// exchange.
+func (f *archivingFetcher) archive(crawlRequestID int, req *http.Request, resp *http.Response, body []byte, truncated bool, via, ip string, date time.Time) {
+	targetURI := req.URL.String()
+	response := warc.NewRecord(warc.TypeResponse, date)
+	response.TargetURI = targetURI
+	response.ContentType = "application/http; msgtype=response"
+	if ip != "" {
+		response.Add("WARC-IP-Address", ip)
+	}
+	response.Add("WARC-Payload-Digest", warc.Digest(body))
+	if truncated {
+		response.Add("WARC-Truncated", "length")
+	}
+	var b bytes.Buffer
+	proto, status := resp.Proto, resp.Status
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	fmt.Fprintf(&b, "%s %s\r\n", proto, status)
+	resp.Header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(body)
+	response.Content = b.Bytes()
+
+	request := warc.NewRecord(warc.TypeRequest, date)
+	request.TargetURI = targetURI
+	request.ContentType = "application/http; msgtype=request"
+	request.Add("WARC-Concurrent-To", response.ID)
+	b = bytes.Buffer{}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	req.Header.Write(&b)
+	if resp.Uncompressed {
+		// the transport asked for a compressed response itself, and has
+		// already decompressed the body
+		b.WriteString("Accept-Encoding: gzip\r\n")
+	}
+	b.WriteString("\r\n")
+	request.Content = b.Bytes()
+
+	metadata := warc.NewRecord(warc.TypeMetadata, date)
+	metadata.TargetURI = targetURI
+	metadata.ContentType = "application/warc-fields"
+	metadata.Add("WARC-Concurrent-To", response.ID)
+	b = bytes.Buffer{}
+	fmt.Fprintf(&b, "crawl-request-id: %d\r\n", crawlRequestID)
+	if via != "" {
+		fmt.Fprintf(&b, "via: %s\r\n", via)
+	}
+	fmt.Fprintf(&b, "fetch-time-ms: %d\r\n", time.Since(date).Milliseconds())
+	metadata.Content = b.Bytes()
+
+	records := []*warc.Record{request, response, metadata}
+	locations, err := f.warcs.WriteRecords(records...)
+	if err != nil {
+		fmt.Printf("Unable to archive %s: %v\n", targetURI, err)
+	}
+	warcRecords := make([]*crawlerdb.WARCRecord, 0, len(locations))
+	for i, loc := range locations {
+		warcRecords = append(warcRecords, &crawlerdb.WARCRecord{
+			CrawlRequestID: crawlRequestID,
+			RecordID:       records[i].ID,
+			Type:           records[i].Type,
+			TargetURI:      targetURI,
+			Filename:       loc.Filename,
+			Offset:         loc.Offset,
+			Length:         loc.Length,
+		})
+	}
+	if err := f.db.AddWARCRecords(warcRecords); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// archivedBody wraps a response body, keeping a copy of every byte read from
+// it, and calling write with the bytes read once it is closed. Nothing more is
+// downloaded for the archive, so the body is reported as truncated unless it
+// was read to the end.
+type archivedBody struct {
+	io.ReadCloser
+	// size is the length of the body if it's known, or -1.
+	size  int64
+	buf   bytes.Buffer
+	eof   bool
+	write func(body []byte, truncated bool)
+	once  sync.Once
+}
+
+func (b *archivedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *archivedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		complete := b.eof || (b.size >= 0 && int64(b.buf.Len()) >= b.size)
+		b.write(b.buf.Bytes(), !complete)
+	})
+	return err
+}
@@ -0,0 +1,54 @@
+package graphcrawler
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchivedBody(t *testing.T) {
+	t.Run("successfully archives bodies that were read to the end", func(tt *testing.T) {
+		var archived []byte
+		var truncated bool
+		body := &archivedBody{
+			ReadCloser: ioutil.NopCloser(strings.NewReader("<html>page</html>")),
+			size:       -1,
+			write:      func(b []byte, t bool) { archived, truncated = append([]byte{}, b...), t },
+		}
+		_, err := ioutil.ReadAll(body)
+		assert.NoError(tt, err)
+		assert.NoError(tt, body.Close())
+		assert.Equal(tt, "<html>page</html>", string(archived))
+		assert.False(tt, truncated)
+	})
+
+	t.Run("successfully archives only what was read of bodies that weren't read to the end", func(tt *testing.T) {
+		var archived []byte
+		var truncated bool
+		body := &archivedBody{
+			ReadCloser: ioutil.NopCloser(strings.NewReader("<html>moved</html>")),
+			size:       18,
+			write:      func(b []byte, t bool) { archived, truncated = append([]byte{}, b...), t },
+		}
+		_, err := body.Read(make([]byte, 6))
+		assert.NoError(tt, err)
+		assert.NoError(tt, body.Close())
+		assert.Equal(tt, "<html>", string(archived))
+		assert.True(tt, truncated)
+	})
+
+	t.Run("successfully archives bodies of a known length read without reaching EOF", func(tt *testing.T) {
+		var truncated bool
+		body := &archivedBody{
+			ReadCloser: ioutil.NopCloser(strings.NewReader("<html>moved</html>")),
+			size:       18,
+			write:      func(b []byte, t bool) { truncated = t },
+		}
+		_, err := body.Read(make([]byte, 18))
+		assert.NoError(tt, err)
+		assert.NoError(tt, body.Close())
+		assert.False(tt, truncated)
+	})
+}
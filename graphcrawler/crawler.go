@@ -1,77 +1,376 @@
 package graphcrawler
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/urlcanon"
+	"github.com/emilyzhang/crawlr/warc"
 )
 
-// GraphCrawler represents a server containing maxWorkers number of workers.
+// Config represents the configuration of a GraphCrawler.
+type Config struct {
+	// MaxWorkers is the number of workers crawling at a time.
+	MaxWorkers int
+	// ClaimBatchSize is the number of tasks claimed from the database at once.
+	// Claimed tasks wait in a prefetch buffer of the same size until a worker
+	// is free to run them.
+	ClaimBatchSize int
+	// IdleMinBackoff and IdleMaxBackoff are the minimum and maximum amount of
+	// time the crawler waits before looking for tasks again when there are
+	// none. The wait doubles every time the crawler doesn't find any.
+	IdleMinBackoff time.Duration
+	IdleMaxBackoff time.Duration
+	// StatsInterval is how often the utilization of the workers is logged.
+	StatsInterval time.Duration
+	// HostMaxConnections is the maximum number of requests that may be made to
+	// a single host at the same time, across all crawlers. It defaults to 2.
+	HostMaxConnections int
+	// HostMinDelay is the minimum delay between the start of two requests to a
+	// single host, across all crawlers. A Crawl-delay in the host's robots.txt
+	// takes precedence over it.
+	HostMinDelay time.Duration
+	// MaxRedirects is the maximum number of redirects followed when crawling a
+	// page. It defaults to 10.
+	MaxRedirects int
+	// MaxBodySize is the maximum number of bytes of an html page that are
+	// downloaded and parsed, anything past that is ignored. It defaults to
+	// 10MB.
+	MaxBodySize int64
+	// Canonicalizer canonicalizes the urls of pages. It must be configured the
+	// same way as the API server's.
+	Canonicalizer *urlcanon.Canonicalizer
+	// MaxSitemapURLs is the maximum number of pages taken from the sitemaps of
+	// a crawl request that uses them.
+	MaxSitemapURLs int
+	// Fetcher makes every http request of the crawler. It defaults to an
+	// HTTPFetcher with the default configuration.
+	Fetcher Fetcher
+	// WARCDir is the directory the http exchanges of crawl requests that ask
+	// for it are archived to as WARC files. Nothing is archived if it is
+	// empty.
+	WARCDir string
+	// WARCMaxFileSize is the size in bytes after which a new WARC file is
+	// started.
+	WARCMaxFileSize int64
+	// Retry is how tasks that fail with a transient error, such as a timeout
+	// or a 503, are retried.
+	Retry RetryPolicy
+	// WorkerID identifies the crawler in the leases of the tasks it claims. It
+	// must be unique across all crawlers, and defaults to the host name and
+	// process id.
+	WorkerID string
+	// TaskTimeout is the maximum amount of time spent on a single task,
+	// including every request and database query it makes.
+	TaskTimeout time.Duration
+	// LeaseDuration is how long a claimed task is leased to the crawler. The
+	// crawler extends the lease while it works on the task, and tasks whose
+	// lease expires are recovered by any crawler.
+	LeaseDuration time.Duration
+}
+
+// GraphCrawler represents a server containing a pool of maxWorkers workers.
 type GraphCrawler struct {
-	maxWorkers int
-	db         *crawlerdb.Postgres
-	wg         *sync.WaitGroup
+	cfg    Config
+	db     store
+	wg     *sync.WaitGroup
+	robots *robotsCache
+	warcs  *warc.Writer
+	// ctx is the context every request is made under, which is cancelled to
+	// abandon the tasks in progress when the crawler is shut down.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stop is closed once the crawler is shutting down, and done once it has
+	// stopped claiming tasks and the tasks in progress have finished.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	// queue is the prefetch buffer the claimed tasks wait in until a worker
+	// picks them up.
+	queue chan claimedTask
+	// workers holds the stats of every worker in the pool.
+	workers []*workerStats
+	// hostSlotTTL is how long a host connection slot is held at most, in case
+	// the crawler holding it dies before releasing it.
+	hostSlotTTL time.Duration
 
 	// TODO: add proper logging
 }
 
+// deferError is returned when a task can't be completed right now, and should
+// be tried again once the given time has passed.
+type deferError struct {
+	until time.Time
+}
+
+func (e *deferError) Error() string {
+	return fmt.Sprintf("task deferred until %s", e.until.Format(time.RFC3339))
+}
+
 // New creates a new GraphCrawler.
-func New(dbDSN string, maxWorkers int) (*GraphCrawler, error) {
+func New(dbDSN string, cfg Config) (*GraphCrawler, error) {
+	if cfg.Canonicalizer == nil {
+		cfg.Canonicalizer = &urlcanon.Canonicalizer{}
+	}
+	if cfg.Fetcher == nil {
+		cfg.Fetcher = NewHTTPFetcher(FetcherConfig{})
+	}
+	if cfg.HostMaxConnections == 0 {
+		cfg.HostMaxConnections = 2
+	} else if cfg.HostMaxConnections < 0 {
+		return nil, fmt.Errorf("Invalid HostMaxConnections %d, must be a positive number", cfg.HostMaxConnections)
+	}
+	if cfg.MaxRedirects == 0 {
+		cfg.MaxRedirects = 10
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = 10 << 20
+	}
+	if cfg.Retry.MaxAttempts == 0 {
+		cfg.Retry.MaxAttempts = 5
+	}
+	if cfg.Retry.BaseDelay == 0 {
+		cfg.Retry.BaseDelay = 30 * time.Second
+	}
+	if cfg.Retry.MaxDelay == 0 {
+		cfg.Retry.MaxDelay = time.Hour
+	}
+	if cfg.Retry.ErrorClasses == nil {
+		cfg.Retry.ErrorClasses = DefaultRetryErrorClasses
+	}
+	if cfg.Retry.StatusCodes == nil {
+		cfg.Retry.StatusCodes = DefaultRetryStatusCodes
+	}
+	if cfg.WorkerID == "" {
+		hostname, _ := os.Hostname()
+		cfg.WorkerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if cfg.LeaseDuration == 0 {
+		cfg.LeaseDuration = time.Minute
+	}
+	if cfg.TaskTimeout == 0 {
+		cfg.TaskTimeout = 10 * time.Minute
+	}
+	// a request can't take longer than the fetcher's timeout if it has one,
+	// or than the task it is made for otherwise
+	hostSlotTTL := cfg.TaskTimeout
+	if f, ok := cfg.Fetcher.(interface{ Timeout() time.Duration }); ok && f.Timeout() > 0 {
+		hostSlotTTL = f.Timeout()
+	}
+	if cfg.ClaimBatchSize == 0 {
+		cfg.ClaimBatchSize = 10
+	}
+	if cfg.IdleMinBackoff == 0 {
+		cfg.IdleMinBackoff = 250 * time.Millisecond
+	}
+	if cfg.IdleMaxBackoff == 0 {
+		cfg.IdleMaxBackoff = 10 * time.Second
+	}
+	if cfg.StatsInterval == 0 {
+		cfg.StatsInterval = time.Minute
+	}
 	// tries connecting to the database 3 times until it gives up
 	retries, count, sleep := 3, 0, 5
-	db, err := crawlerdb.New(dbDSN)
+	db, err := crawlerdb.New(dbDSN, cfg.Canonicalizer)
 	for err != nil {
 		if count > retries {
 			return nil, err
 		}
 		time.Sleep(time.Duration(sleep) * time.Second)
 		sleep += 3
-		db, err = crawlerdb.New(dbDSN)
+		db, err = crawlerdb.New(dbDSN, cfg.Canonicalizer)
 		count++
 	}
 
-	return &GraphCrawler{
-		db:         db,
-		maxWorkers: maxWorkers,
-		wg:         &sync.WaitGroup{},
-	}, nil
+	// archive the requests of crawl requests that ask for it, and record
+	// every request the crawler makes
+	var warcs *warc.Writer
+	if cfg.WARCDir != "" {
+		warcs = warc.NewWriter(warc.Config{
+			Dir:         cfg.WARCDir,
+			Prefix:      robotsUserAgent,
+			MaxFileSize: cfg.WARCMaxFileSize,
+			Info: []warc.Field{
+				{Name: "software", Value: defaultUserAgent},
+				{Name: "format", Value: "WARC File Format 1.1"},
+				{Name: "conformsTo", Value: "http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/"},
+			},
+		})
+	}
+	cfg.Fetcher = &archivingFetcher{Fetcher: cfg.Fetcher, db: db, warcs: warcs}
+	cfg.Fetcher = &loggingFetcher{Fetcher: cfg.Fetcher, db: db, canonicalizer: cfg.Canonicalizer}
+	ctx, cancel := context.WithCancel(context.Background())
+	workers := make([]*workerStats, cfg.MaxWorkers)
+	for i := range workers {
+		workers[i] = newWorkerStats(i, time.Now())
+	}
+	c := &GraphCrawler{
+		cfg:         cfg,
+		db:          db,
+		wg:          &sync.WaitGroup{},
+		warcs:       warcs,
+		ctx:         ctx,
+		cancel:      cancel,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		queue:       make(chan claimedTask, cfg.ClaimBatchSize),
+		workers:     workers,
+		hostSlotTTL: hostSlotTTL,
+	}
+	c.robots = newRobotsCache(cfg.Fetcher, c.waitForHostSlot)
+	return c, nil
 }
 
-// Start starts the GraphCrawler server, which will spawn up to maxWorkers
-// number of workers at a time to grab tasks from the database and complete
-// them.
+// Start starts the GraphCrawler server, which will spawn a pool of maxWorkers
+// workers that each grab a task from the prefetch buffer, complete it, and
+// move on to the next one, while the buffer is kept filled with tasks claimed
+// from the database in batches. It returns once the crawler is shut down and
+// every worker has finished its task.
 func (c *GraphCrawler) Start() {
+	defer close(c.done)
 	fmt.Println("Starting graph crawler. Hello world!")
+	go c.recoverExpiredTasks()
+	go c.logStats()
+	c.wg.Add(1)
+	go c.prefetch()
+	for _, w := range c.workers {
+		c.wg.Add(1)
+		go c.worker(w)
+	}
+	c.wg.Wait()
+	c.drainQueue()
+}
+
+// abandonTimeout is how long Shutdown waits for the workers to return once it
+// has cancelled the requests of their unfinished tasks.
+const abandonTimeout = 5 * time.Second
+
+// Shutdown gracefully shuts down a started crawler: it stops claiming new
+// tasks and waits for the tasks in progress to finish. If ctx expires first,
+// the requests of the unfinished tasks are cancelled, and the workers are given
+// abandonTimeout to return. The unfinished tasks and those left in the prefetch
+// buffer are released so that another crawler can pick them up right away.
+// Either way, the crawler's WARC files and database connections are closed.
+func (c *GraphCrawler) Shutdown(ctx context.Context) error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	var err error
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.cancel()
+		select {
+		case <-c.done:
+		case <-time.After(abandonTimeout):
+			fmt.Println("Workers didn't return after their tasks were cancelled, closing the crawler anyway.")
+		}
+	}
+	n, releaseErr := c.db.ReleaseTasks(c.cfg.WorkerID)
+	if releaseErr != nil {
+		fmt.Println(releaseErr)
+	} else if n > 0 {
+		fmt.Printf("Released %d unfinished tasks.\n", n)
+	}
+	if c.warcs != nil {
+		if closeErr := c.warcs.Close(); closeErr != nil {
+			fmt.Printf("Unable to close WARC file: %v\n", closeErr)
+		}
+	}
+	c.cancel()
+	c.db.Close()
+	return err
+}
+
+// stopping reports whether the crawler is shutting down.
+func (c *GraphCrawler) stopping() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// recoverExpiredTasks periodically returns tasks whose lease expired to the
+// queue, which happens when the crawler working on them died. Every crawler
+// runs it, so tasks are recovered as long as any crawler is up.
+func (c *GraphCrawler) recoverExpiredTasks() {
+	ticker := time.NewTicker(c.cfg.LeaseDuration / 2)
+	defer ticker.Stop()
 	for {
-		for i := 0; i < c.maxWorkers; i++ {
-			t, err := c.db.FindIncompleteTask()
-			if err != nil {
-				// don't want to log error if there are simply no tasks yet
-				if err != crawlerdb.ErrNoTasksAvailable {
-					c.handleError(t, err)
-				}
-			} else {
-				c.wg.Add(1)
-				go c.run(t)
-			}
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		n, err := c.db.RecoverExpiredTasks(c.cfg.Retry.MaxAttempts)
+		if err != nil {
+			fmt.Println(err)
+		} else if n > 0 {
+			fmt.Printf("Recovered %d tasks whose lease expired.\n", n)
 		}
-		c.wg.Wait()
 	}
-	// TODO: implement graceful server shut down
+}
 
-	// TODO: implement task retries (when the server is unexpectedly shut down,
-	// some tasks may be left in "IN_PROGRESS" state after worker death)
+// heartbeat extends the lease of a task every third of the lease duration
+// until the returned function is called, which must be called once the task is
+// finished or put aside. The returned channel is closed if the lease is lost.
+func (c *GraphCrawler) heartbeat(t *crawlerdb.Task) (func(), <-chan struct{}) {
+	done := make(chan struct{})
+	lost := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.cfg.LeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := c.db.ExtendTaskLease(t.ID, c.cfg.WorkerID, c.cfg.LeaseDuration)
+				select {
+				case <-done:
+					// the task was finished in the meantime
+					return
+				default:
+				}
+				if err == crawlerdb.ErrLeaseLost {
+					fmt.Printf("CrawlRequest %v: Lost the lease of task %d (url %s), another worker may crawl it again\n", t.CrawlRequestID, t.ID, t.PageURL)
+					close(lost)
+					return
+				} else if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }, lost
 }
 
 // run completes a task by grabbing the page associated with the task, finding
-// the next pages for this page, and adding new tasks for those pages.
-func (c *GraphCrawler) run(t *crawlerdb.Task) {
-	defer c.wg.Done()
-	cr, err := c.db.GetCrawlRequest(t.CrawlRequestID)
+// the next pages for this page, and adding new tasks for those pages. The task
+// is abandoned if it takes longer than TaskTimeout, or once leaseLost is closed
+// because another worker may have claimed it since.
+func (c *GraphCrawler) run(t *crawlerdb.Task, leaseLost <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.TaskTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-leaseLost:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	cr, err := c.db.GetCrawlRequestContext(ctx, t.CrawlRequestID)
 	if err != nil {
-		c.handleError(t, err)
+		c.handleError(ctx, t, err)
 		return
 	}
 
@@ -79,98 +378,608 @@ func (c *GraphCrawler) run(t *crawlerdb.Task) {
 	// already crawled this page, we don't need to crawl those pages, we just
 	// needed the task to be created for host counting purposes
 	if t.CurrentLevel == cr.Levels || t.SeenURL {
-		c.db.UpdateTaskStatus(t.ID, "COMPLETED")
+		c.db.UpdateTaskStatusContext(ctx, t.ID, c.cfg.WorkerID, "COMPLETED")
 		return
 	}
 
 	fmt.Printf("CrawlRequest %d: Crawling new page (url %s, level %d)\n", t.CrawlRequestID, t.PageURL, t.CurrentLevel)
 	// get relevant page node
-	p, err := c.db.UpsertPage(t.PageURL)
+	p, err := c.db.UpsertPageContext(ctx, t.PageURL)
+	if err != nil {
+		c.handleError(ctx, t, err)
+		return
+	}
+	page, err := c.db.GetPageContext(ctx, p)
 	if err != nil {
-		c.handleError(t, err)
+		c.handleError(ctx, t, err)
 		return
 	}
-	page, err := c.db.GetPage(p)
+
+	// follow any redirects we already know about to the page that actually has
+	// content
+	page, err = c.resolveRedirects(ctx, page, cr)
 	if err != nil {
-		c.handleError(t, err)
+		c.handleError(ctx, t, err)
 		return
 	}
 
 	// find next urls, either using the already unfolded graph, or by crawling
-	// the current page.
-	var urls []string
-	if !page.CrawledStatus {
-		urls, err = c.crawlPage(page)
-		if err != nil {
-			c.handleError(t, err)
+	// the current page if it hasn't been crawled yet or has gone stale.
+	var links []crawlerdb.Link
+	crawled := needsCrawl(page, cr)
+	if crawled {
+		page, links, err = c.crawlPage(ctx, page, cr)
+		if err == errBlockedByRobots {
+			fmt.Printf("CrawlRequest %d: Skipping page disallowed by robots.txt (url %s)\n", t.CrawlRequestID, t.PageURL)
+			err = c.db.UpdateTaskStatusContext(ctx, t.ID, c.cfg.WorkerID, "BLOCKED")
+			if err != nil {
+				c.handleError(ctx, t, err)
+			}
+			return
+		} else if de, ok := err.(*deferError); ok {
+			// the host is being crawled too much right now, so try this task
+			// again later
+			err = c.db.DeferTaskContext(ctx, t.ID, c.cfg.WorkerID, de.until)
+			if err != nil {
+				c.handleError(ctx, t, err)
+			}
+			return
+		} else if err != nil {
+			c.handleError(ctx, t, err)
 			return
 		}
 	} else {
-		urls, err = c.nextPagesFromEdges(page)
+		links, err = c.nextPagesFromEdges(ctx, page, cr)
+		if err != nil {
+			c.handleError(ctx, t, err)
+			return
+		}
+	}
+
+	if cr.CollapseDuplicates {
+		// crawl the canonical page in place of a duplicate
+		page, links, err = c.collapse(ctx, page, links, cr)
+		if de, ok := err.(*deferError); ok {
+			err = c.db.DeferTaskContext(ctx, t.ID, c.cfg.WorkerID, de.until)
+			if err != nil {
+				c.handleError(ctx, t, err)
+			}
+			return
+		} else if err != nil {
+			c.handleError(ctx, t, err)
+			return
+		}
+		// don't add the same links twice if another task already ended up at
+		// the same page
+		added, err := c.db.LinksAddedForURLContext(ctx, cr.ID, t.ID, page.URL)
+		if err != nil {
+			c.handleError(ctx, t, err)
+			return
+		}
+		if added {
+			links = nil
+		}
+	} else if page.CanonicalURL != "" && page.CanonicalURL != page.URL {
+		// crawl the canonical page anyway, so its status is known when the
+		// mismatch is reported
+		_, err = c.crawlCanonical(ctx, page, cr)
+		if de, ok := err.(*deferError); ok {
+			err = c.db.DeferTaskContext(ctx, t.ID, c.cfg.WorkerID, de.until)
+			if err != nil {
+				c.handleError(ctx, t, err)
+			}
+			return
+		} else if err != nil {
+			c.handleError(ctx, t, err)
+			return
+		}
+	}
+
+	if cr.ReuseDuplicates {
+		// follow the links of the page this page is a duplicate of instead
+		links, err = c.duplicateLinks(ctx, page, links, cr)
+		if err != nil {
+			c.handleError(ctx, t, err)
+			return
+		}
+	}
+
+	// remember where the task ended up if it was redirected
+	if page.URL != t.PageURL {
+		err = c.db.UpdateTaskFinalURLContext(ctx, t.ID, c.cfg.WorkerID, page.URL)
 		if err != nil {
-			c.handleError(t, err)
+			c.handleError(ctx, t, err)
 			return
 		}
 	}
 
-	// add tasks for outlinks on the page
-	err = c.addNewTasks(t, cr.ID, cr.Levels, urls)
+	// the first page of a crawl request that uses sitemaps also links to every
+	// page in its host's sitemaps
+	urls := followedURLs(links, cr)
+	if t.CurrentLevel == 0 && cr.UseSitemaps {
+		sitemapURLs, err := c.sitemapURLs(ctx, cr.ID, page, links, crawled)
+		if err != nil {
+			c.handleError(ctx, t, err)
+			return
+		}
+		urls = append(urls, sitemapURLs...)
+	}
+
+	// don't add tasks for a task that was abandoned in the meantime
+	if ctx.Err() != nil {
+		c.handleError(ctx, t, ctx.Err())
+		return
+	}
+
+	// add tasks for outlinks on the page that the crawl request follows
+	err = c.addNewTasks(ctx, t, cr.ID, cr.Levels, urls)
 	if err != nil {
-		c.handleError(t, err)
+		c.handleError(ctx, t, err)
 		return
 	}
 
 	// updates task status
-	err = c.db.UpdateTaskStatus(t.ID, "COMPLETED")
+	err = c.db.UpdateTaskStatusContext(ctx, t.ID, c.cfg.WorkerID, "COMPLETED")
 	if err != nil {
-		c.handleError(t, err)
+		c.handleError(ctx, t, err)
 		return
 	}
 }
 
 // crawlPage unfolds the graph by crawling the page and adding new page nodes
-// and edges associated with the current page and returns a slice of strings
-// representing urls for the next pages.
-func (c *GraphCrawler) crawlPage(page *crawlerdb.Page) ([]string, error) {
-	var urls []string
-	resp, err := getRequest(page.URL)
+// and edges associated with the current page, replacing any edges the page
+// already had. Redirects are followed up to MaxRedirects times, with every hop
+// recorded as a redirect edge. If the page has been crawled before, it is
+// revalidated with a conditional request and its edges are only replaced if
+// it has changed. Every request is archived if the crawl request asks for it.
+// It returns the page node that the redirects ended up at and the links found
+// on that page.
+func (c *GraphCrawler) crawlPage(ctx context.Context, page *crawlerdb.Page, cr *crawlerdb.CrawlRequest) (*crawlerdb.Page, []crawlerdb.Link, error) {
+	var links []crawlerdb.Link
+	var hops []redirect
+	pageURL := page.URL
+	header := http.Header{}
+	if page.CrawledStatus {
+		if page.ETag != "" {
+			header.Set("If-None-Match", page.ETag)
+		}
+		if page.LastModified != "" {
+			header.Set("If-Modified-Since", page.LastModified)
+		}
+	}
+	visited := map[string]bool{pageURL: true}
+	ctx = withCrawlRequest(ctx, cr.ID)
+	archive := func(via string) context.Context {
+		if cr.ArchiveWARC {
+			return withArchive(ctx, via)
+		}
+		return ctx
+	}
+	resp, err := c.fetchUnified(archive(""), pageURL, header)
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		// the page hasn't changed since it was last crawled, so its edges are
+		// still up to date
+		resp.Body.Close()
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			page.ETag = etag
+		}
+		if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+			page.LastModified = lastModified
+		}
+		err = c.db.UpdatePageFetchContext(ctx, page)
+		if err != nil {
+			return page, links, err
+		}
+		links, err = c.nextPagesFromEdges(ctx, page, cr)
+		return page, links, err
+	}
+	for err == nil && isRedirect(resp) {
+		resp.Body.Close()
+		var location string
+		location, err = redirectLocation(resp, pageURL)
+		if err != nil {
+			return page, links, err
+		}
+		hops = append(hops, redirect{url: pageURL, statusCode: resp.StatusCode, location: location})
+		if len(hops) > c.cfg.MaxRedirects {
+			return page, links, fmt.Errorf("Stopped after %d redirects", c.cfg.MaxRedirects)
+		} else if visited[location] {
+			return page, links, fmt.Errorf("Redirect loop detected at %s", location)
+		}
+		visited[location] = true
+		resp, err = c.fetchUnified(archive(pageURL), location, nil)
+		pageURL = location
+	}
+	if se, ok := err.(*statusError); ok && len(hops) == 0 {
+		// remember what the page responded with, so broken canonical urls can
+		// be reported
+		if err := c.db.UpdatePageStatusContext(ctx, page.ID, se.statusCode); err != nil {
+			fmt.Println(err)
+		}
+	}
 	if err != nil {
-		return urls, err
+		return page, links, err
+	}
+
+	// record every hop of the redirect chain, the page at the end of the chain
+	// is the one that gets parsed
+	for _, h := range hops {
+		location, err := c.cfg.Canonicalizer.Canonicalize(h.location)
+		if err != nil {
+			resp.Body.Close()
+			return page, links, err
+		}
+		if location == page.URL {
+			// the redirect only changed the url to another spelling of the
+			// same page, such as adding a trailing slash
+			continue
+		}
+		targetID, err := c.db.AddRedirectEdgeContext(ctx, page.ID, location, h.statusCode)
+		if err != nil {
+			resp.Body.Close()
+			return page, links, err
+		}
+		page, err = c.db.GetPageContext(ctx, targetID)
+		if err != nil {
+			resp.Body.Close()
+			return page, links, err
+		}
+	}
+	if len(hops) > 0 && !needsCrawl(page, cr) {
+		// the page at the end of the chain has already been crawled recently,
+		// so its edges can be reused
+		resp.Body.Close()
+		links, err = c.nextPagesFromEdges(ctx, page, cr)
+		return page, links, err
 	}
-	paths := findRawURLs(resp)
-	urls, err = filterURLs(paths, page.URL)
+
+	// the X-Robots-Tag header applies to any kind of page
+	var noindex, nofollow bool
+	var canonicalURL string
+	var metadata crawlerdb.PageMetadata
+	var text string
+	page.ContentHash, page.SimHash = "", 0
+	for _, v := range resp.Header["X-Robots-Tag"] {
+		ni, nf := parseRobotsDirectives(v)
+		noindex, nofollow = noindex || ni, nofollow || nf
+	}
+
+	// only html pages are parsed for links, any other page is a leaf in the
+	// graph
+	body, err := readHTML(resp, page, c.cfg.MaxBodySize)
+	if err != nil {
+		return page, links, err
+	}
+	if body != nil {
+		doc := parseHTML(bytes.NewReader(body))
+		noindex, nofollow = noindex || doc.noindex, nofollow || doc.nofollow
+		canonicalURL = doc.canonicalURL(page.URL, c.cfg.Canonicalizer)
+		text = collapseSpace(doc.text.String())
+		words := textWords(text)
+		page.ContentHash, page.SimHash = fingerprint(words)
+		metadata = doc.metadata
+		metadata.WordCount = len(words)
+		links, err = filterURLs(doc.links, doc.baseURL(page.URL), c.cfg.Canonicalizer)
+		if err != nil {
+			return page, links, err
+		}
+	}
+	// a nofollow page is recorded, but none of its links are
+	if nofollow {
+		links = nil
+	}
+	page.NoIndex = noindex
+	page.DuplicateOf, err = c.db.FindDuplicatePageContext(ctx, page)
+	if err != nil {
+		return page, links, err
+	}
+	// a duplicate that is followed with the links of its original doesn't get
+	// edges of its own, so it doesn't grow a parallel part of the graph
+	if cr.ReuseDuplicates && page.DuplicateOf != 0 {
+		links = nil
+	}
+	err = c.db.UpdatePageEdgesContext(ctx, page.ID, links)
+	if err != nil {
+		return page, links, err
+	}
+	if page.AliasOf != 0 && canonicalURL != page.CanonicalURL {
+		// the page's rel=canonical changed, so it's no longer an alias of the
+		// page it was collapsed into
+		err = c.db.UnmergeAliasContext(ctx, page.ID)
+		if err != nil {
+			return page, links, err
+		}
+		page.AliasOf = 0
+	}
+	page.CanonicalURL = canonicalURL
+	page.StatusCode = resp.StatusCode
+	err = c.db.UpdatePageMetadataContext(ctx, page.ID, &metadata)
+	if err != nil {
+		return page, links, err
+	}
+	// index the page's text for full-text search
+	err = c.db.UpdatePageContentContext(ctx, page.ID, text, &metadata)
+	if err != nil {
+		return page, links, err
+	}
+	page.ETag, page.LastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	err = c.db.UpdatePageFetchContext(ctx, page)
+	if err != nil {
+		return page, links, err
+	}
+	return page, links, nil
+}
+
+// fetch makes a single GET request to the given url with the given headers
+// under the given context, which says which crawl request the request is made
+// for, after making sure that the request is allowed by the host's robots.txt
+// and that the host has request budget available. The host's connection slot
+// is released once the response body is closed.
+func (c *GraphCrawler) fetch(ctx context.Context, pageURL string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+	rb, err := c.robots.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if !rb.allowed(robotsUserAgent, u) {
+		return nil, errBlockedByRobots
+	}
+
+	// make sure the host isn't crawled more than it can handle
+	delay := c.cfg.HostMinDelay
+	if d := rb.crawlDelay(robotsUserAgent); d > 0 {
+		delay = d
+	}
+	slot, retryAt, err := c.db.AcquireHostSlotContext(ctx, u.Hostname(), c.cfg.HostMaxConnections, delay, c.hostSlotTTL)
+	if err == crawlerdb.ErrHostOverBudget {
+		return nil, &deferError{until: retryAt}
+	} else if err != nil {
+		return nil, err
+	}
+
+	resp, err := getRequest(ctx, c.cfg.Fetcher, pageURL, header)
+	if err != nil {
+		c.db.ReleaseHostSlot(slot)
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { c.db.ReleaseHostSlot(slot) }}
+	return resp, nil
+}
+
+// waitForHostSlot acquires a connection slot for the given host, waiting until
+// the host has request budget available unless ctx is done first. It's used
+// for robots.txt files, which are needed before the host's Crawl-delay is
+// known, so only HostMinDelay applies. It returns a function that releases the
+// slot.
+func (c *GraphCrawler) waitForHostSlot(ctx context.Context, host string) (func(), error) {
+	for {
+		slot, retryAt, err := c.db.AcquireHostSlotContext(ctx, host, c.cfg.HostMaxConnections, c.cfg.HostMinDelay, c.hostSlotTTL)
+		if err == crawlerdb.ErrHostOverBudget {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Until(retryAt)):
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return func() { c.db.ReleaseHostSlot(slot) }, nil
+	}
+}
+
+// fetchUnified makes a request like fetch, but if the canonicalizer unifies
+// schemes and the url's host can't be reached over https, it falls back to
+// http, since the url may have been rewritten from an http url of a site that
+// doesn't serve https at all.
+func (c *GraphCrawler) fetchUnified(ctx context.Context, pageURL string, header http.Header) (*http.Response, error) {
+	resp, err := c.fetch(ctx, pageURL, header)
+	if err == nil || !c.cfg.Canonicalizer.UnifySchemes || !strings.HasPrefix(pageURL, "https://") {
+		return resp, err
+	}
+	// a plain http server answering the tls handshake is reported with an
+	// error of its own rather than as a tls error
+	mismatch := strings.Contains(err.Error(), "server gave HTTP response to HTTPS client")
+	if class := errorClass(err); !mismatch && class != "connect" && class != "tls" && class != "reset" {
+		return resp, err
+	}
+	fmt.Printf("Unable to fetch %s over https, falling back to http: %v\n", pageURL, err)
+	return c.fetch(ctx, "http://"+strings.TrimPrefix(pageURL, "https://"), header)
+}
+
+// resolveRedirects follows the redirect edges of an already crawled page, and
+// returns the page node at the end of the redirect chain. It stops early at
+// any page that needs to be crawled again.
+func (c *GraphCrawler) resolveRedirects(ctx context.Context, page *crawlerdb.Page, cr *crawlerdb.CrawlRequest) (*crawlerdb.Page, error) {
+	for i := 0; !needsCrawl(page, cr); i++ {
+		if i > c.cfg.MaxRedirects {
+			return page, fmt.Errorf("Stopped after %d redirects", c.cfg.MaxRedirects)
+		}
+		edges, err := c.db.GetEdgesForPageContext(ctx, page)
+		if err != nil {
+			return page, err
+		}
+		if len(edges) == 0 || edges[0].Kind != "redirect" {
+			return page, nil
+		}
+		page, err = c.db.GetPageContext(ctx, edges[0].TargetID)
+		if err != nil {
+			return page, err
+		}
+	}
+	return page, nil
+}
+
+// sitemapURLs returns the urls of the pages in the sitemaps of the given page's
+// host. Sitemaps are only fetched again if the page was just crawled, or if it
+// has no sitemap edges yet, otherwise its existing sitemap edges are used.
+func (c *GraphCrawler) sitemapURLs(ctx context.Context, crawlRequestID int, page *crawlerdb.Page, links []crawlerdb.Link, crawled bool) ([]string, error) {
+	var urls []string
+	for _, l := range links {
+		if l.Kind == crawlerdb.EdgeKindSitemap {
+			urls = append(urls, l.URL)
+		}
+	}
+	if !crawled && len(urls) > 0 {
+		return urls, nil
+	}
+
+	fmt.Printf("Discovering sitemaps for page %s\n", page.URL)
+	sitemapLinks, err := c.sitemapLinks(ctx, crawlRequestID, page, c.cfg.MaxSitemapURLs)
 	if err != nil {
-		return urls, err
+		return nil, err
 	}
-	err = c.db.UpdatePageEdges(page.ID, urls)
+	err = c.db.UpdateSitemapEdgesContext(ctx, page.ID, sitemapLinks)
 	if err != nil {
-		return urls, err
+		return nil, err
+	}
+	urls = urls[:0]
+	for _, l := range sitemapLinks {
+		urls = append(urls, l.URL)
 	}
 	return urls, nil
 }
 
+// collapse treats a page whose rel=canonical points at another page as an
+// alias of that page: the canonical page is crawled if necessary, the alias's
+// edges are merged into it, and the canonical page and its links are returned
+// in place of the alias. Pages aren't collapsed into canonical pages that
+// can't be crawled, or that declare yet another canonical url themselves.
+func (c *GraphCrawler) collapse(ctx context.Context, page *crawlerdb.Page, links []crawlerdb.Link, cr *crawlerdb.CrawlRequest) (*crawlerdb.Page, []crawlerdb.Link, error) {
+	if page.CanonicalURL == "" || page.CanonicalURL == page.URL {
+		return page, links, nil
+	}
+	canonical, err := c.crawlCanonical(ctx, page, cr)
+	if err != nil || canonical == nil {
+		return page, links, err
+	}
+	if canonical.ID == page.ID || (canonical.CanonicalURL != "" && canonical.CanonicalURL != canonical.URL) {
+		return page, links, nil
+	}
+
+	err = c.db.MergeAliasContext(ctx, page.ID, canonical.ID)
+	if err != nil {
+		return page, links, err
+	}
+	links, err = c.nextPagesFromEdges(ctx, canonical, cr)
+	return canonical, links, err
+}
+
+// crawlCanonical returns the page node of a page's canonical url, following
+// the redirects already known for it, after crawling it if necessary, which
+// also records the status code it responds with. If it can't be crawled, the
+// error is only logged and nil is returned, unless the crawl was deferred.
+func (c *GraphCrawler) crawlCanonical(ctx context.Context, page *crawlerdb.Page, cr *crawlerdb.CrawlRequest) (*crawlerdb.Page, error) {
+	id, err := c.db.UpsertPageContext(ctx, page.CanonicalURL)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := c.db.GetPageContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	canonical, err = c.resolveRedirects(ctx, canonical, cr)
+	if err != nil {
+		return nil, err
+	}
+	if needsCrawl(canonical, cr) {
+		canonical, _, err = c.crawlPage(ctx, canonical, cr)
+		if _, ok := err.(*deferError); ok {
+			return nil, err
+		} else if err != nil {
+			fmt.Printf("Unable to crawl canonical page %s of page %s: %v\n", page.CanonicalURL, page.URL, err)
+			return nil, nil
+		}
+	}
+	return canonical, nil
+}
+
+// duplicateLinks returns the links of the original page a page is an exact
+// duplicate of, as long as the original page still has the same content, or
+// the given links otherwise.
+func (c *GraphCrawler) duplicateLinks(ctx context.Context, page *crawlerdb.Page, links []crawlerdb.Link, cr *crawlerdb.CrawlRequest) ([]crawlerdb.Link, error) {
+	if page.DuplicateOf == 0 {
+		return links, nil
+	}
+	original, err := c.db.GetPageContext(ctx, page.DuplicateOf)
+	if err != nil {
+		return links, err
+	}
+	if original.ContentHash != page.ContentHash {
+		return links, nil
+	}
+	fmt.Printf("CrawlRequest %d: Reusing links of page %s for duplicate page %s\n", cr.ID, original.URL, page.URL)
+	return c.nextPagesFromEdges(ctx, original, cr)
+}
+
+// needsCrawl reports whether a page has to be crawled to find its next pages,
+// either because it has never been crawled, or because it was last crawled
+// longer ago than the crawl request's MaxAge.
+func needsCrawl(page *crawlerdb.Page, cr *crawlerdb.CrawlRequest) bool {
+	if !page.CrawledStatus {
+		return true
+	}
+	maxAge := time.Duration(cr.MaxAge) * time.Second
+	return maxAge > 0 && time.Since(page.FetchedAt) > maxAge
+}
+
 // nextPagesFromEdges grabs next pages using already existing edges in the graph
-// and returns a slice of strings representing urls for the next pages.
-func (c *GraphCrawler) nextPagesFromEdges(page *crawlerdb.Page) ([]string, error) {
-	var urls []string
-	edges, err := c.db.GetEdgesForPage(page)
+// and returns a slice of links to the next pages. Edges merged from the page's
+// aliases are only used if the crawl request collapses duplicates. A duplicate
+// page without edges of its own uses the edges of its original page.
+func (c *GraphCrawler) nextPagesFromEdges(ctx context.Context, page *crawlerdb.Page, cr *crawlerdb.CrawlRequest) ([]crawlerdb.Link, error) {
+	var links []crawlerdb.Link
+	edges, err := c.db.GetEdgesForPageContext(ctx, page)
 	if err != nil {
-		return urls, err
+		return links, err
+	}
+	if len(edges) == 0 && page.DuplicateOf != 0 {
+		original, err := c.db.GetPageContext(ctx, page.DuplicateOf)
+		if err != nil {
+			return links, err
+		}
+		edges, err = c.db.GetEdgesForPageContext(ctx, original)
+		if err != nil {
+			return links, err
+		}
 	}
 	for _, e := range edges {
-		nextTaskPage, err := c.db.GetPage(e.TargetID)
+		if e.MergedFrom != 0 && !cr.CollapseDuplicates {
+			continue
+		}
+		nextTaskPage, err := c.db.GetPageContext(ctx, e.TargetID)
 		if err != nil {
-			return urls, err
+			return links, err
 		}
-		urls = append(urls, nextTaskPage.URL)
+		links = append(links, crawlerdb.Link{URL: nextTaskPage.URL, Kind: e.Kind, Rel: e.Rel})
 	}
-	return urls, nil
+	return links, nil
+}
+
+// followedURLs returns the urls of the links whose kind is followed by the
+// given crawl request, leaving out nofollow links if the crawl request asks
+// for it.
+func followedURLs(links []crawlerdb.Link, cr *crawlerdb.CrawlRequest) []string {
+	follow := make(map[string]bool)
+	for _, k := range cr.FollowKinds {
+		follow[k] = true
+	}
+	var urls []string
+	for _, l := range links {
+		if follow[l.Kind] && !(cr.SkipNofollow && isNofollow(l.Rel)) {
+			urls = append(urls, l.URL)
+		}
+	}
+	return urls
 }
 
 // addNewTasks adds new tasks to the database, if necessary.
-func (c *GraphCrawler) addNewTasks(t *crawlerdb.Task, crawlRequestID int, levels int, urls []string) error {
+func (c *GraphCrawler) addNewTasks(ctx context.Context, t *crawlerdb.Task, crawlRequestID int, levels int, urls []string) error {
 	crawledURLs := make(map[string]bool)
-	tasks, err := c.db.GetCrawlRequestTasks(crawlRequestID)
+	tasks, err := c.db.GetCrawlRequestTasksContext(ctx, crawlRequestID)
 	if err != nil {
 		return err
 	}
@@ -178,36 +987,68 @@ func (c *GraphCrawler) addNewTasks(t *crawlerdb.Task, crawlRequestID int, levels
 		crawledURLs[t.PageURL] = true
 	}
 	var count int
-	var seen bool
+	var newTasks []*crawlerdb.Task
 	if t.CurrentLevel < levels {
 		for _, u := range urls {
-			if crawledURLs[u] {
-				seen = true
-			} else {
-				seen = false
+			seen := crawledURLs[u]
+			if !seen {
 				crawledURLs[u] = true
 				count++
 			}
-			err := c.db.CreateTask(t.CrawlRequestID, u, t.CurrentLevel+1, seen)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
+			newTasks = append(newTasks, &crawlerdb.Task{CrawlRequestID: t.CrawlRequestID, PageURL: u, CurrentLevel: t.CurrentLevel + 1, SeenURL: seen})
 		}
 	}
+	err = c.db.CreateTasksContext(ctx, newTasks)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("CrawlRequest %d: Added %d new tasks that actually need crawling.\n", crawlRequestID, count)
 	return nil
 }
 
-// handleError prints out an informative error message and sets the task status
-// to FAILED in the event of an error.
-func (c *GraphCrawler) handleError(t *crawlerdb.Task, err error) {
-	fmt.Printf("CrawlRequest %v: Error while crawling task %d (url %s) at level %d: %s\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel, err)
-	if t != nil {
-		err = c.db.UpdateTaskStatus(t.ID, "FAILED")
-		if err != nil {
-			fmt.Printf("CrawlRequest %v: Error while updating task %d (url %s) at level %d: %s\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel, err)
-		}
+// leaseLost reports whether the task ctx belongs to was abandoned because its
+// lease was lost, which is the only reason a task's context is cancelled while
+// the crawler is still running.
+func (c *GraphCrawler) leaseLost(ctx context.Context) bool {
+	return ctx.Err() == context.Canceled && c.ctx.Err() == nil
+}
+
+// handleError prints out an informative error message in the event of an
+// error. If the error is transient and the task has attempts left under the
+// retry policy, the task is retried after a backoff, otherwise its status is set
+// to FAILED. ctx is the context the task ran under, and a task that ran out of
+// time is retried like a request that timed out.
+func (c *GraphCrawler) handleError(ctx context.Context, t *crawlerdb.Task, err error) {
+	if t == nil {
+		fmt.Println(err)
+		return
+	}
+	if c.ctx.Err() != nil {
+		// the crawler is shutting down and abandoned the task, which it
+		// releases rather than counting this as a failed attempt
+		fmt.Printf("CrawlRequest %v: Abandoned task %d (url %s) at level %d while shutting down: %s\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel, err)
+		return
+	}
+	if err == crawlerdb.ErrLeaseLost || c.leaseLost(ctx) {
+		// another worker may have claimed the task since, so it is left alone
+		fmt.Printf("CrawlRequest %v: Lost the lease of task %d (url %s) at level %d, leaving it to another worker\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel)
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		// whatever failed was most likely cut short by the task's deadline
+		err = fmt.Errorf("Task took longer than %s: %w", c.cfg.TaskTimeout, ctx.Err())
+	}
+	attempts := t.Attempts + 1
+	if c.cfg.Retry.retryable(err) && attempts < c.cfg.Retry.MaxAttempts {
+		delay := c.cfg.Retry.backoff(attempts)
+		fmt.Printf("CrawlRequest %v: Error while crawling task %d (url %s) at level %d, retrying in %s (attempt %d of %d): %s\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel, delay, attempts, c.cfg.Retry.MaxAttempts, err)
+		err = c.db.RetryTask(t.ID, c.cfg.WorkerID, err.Error(), time.Now().Add(delay))
+	} else {
+		fmt.Printf("CrawlRequest %v: Error while crawling task %d (url %s) at level %d: %s\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel, err)
+		err = c.db.FailTask(t.ID, c.cfg.WorkerID, err.Error())
+	}
+	if err != nil {
+		fmt.Printf("CrawlRequest %v: Error while updating task %d (url %s) at level %d: %s\n", t.CrawlRequestID, t.ID, t.PageURL, t.CurrentLevel, err)
 	}
 	// debug.PrintStack()
 }
@@ -0,0 +1,446 @@
+package graphcrawler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/urlcanon"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedirect is a redirect edge recorded by fakeStore.
+type fakeRedirect struct {
+	from, to   string
+	statusCode int
+}
+
+// errNotFaked is returned by the fakeStore methods the crawler doesn't call
+// while running a task.
+var errNotFaked = errors.New("not implemented by fakeStore")
+
+// fakeStore is an in-memory store that implements what running a task needs.
+// The other methods return errNotFaked.
+type fakeStore struct {
+	crawlRequests map[int]*crawlerdb.CrawlRequest
+	tasks         []*crawlerdb.Task
+	pages         []*crawlerdb.Page
+	edges         map[int][]crawlerdb.Link
+	redirects     []fakeRedirect
+	// duplicates maps the content hash of a page to the original page it is
+	// a duplicate of.
+	duplicates map[string]int
+	fetches    []*crawlerdb.PageFetch
+}
+
+var _ store = (*fakeStore)(nil)
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{crawlRequests: make(map[int]*crawlerdb.CrawlRequest), edges: make(map[int][]crawlerdb.Link)}
+}
+
+func (s *fakeStore) GetCrawlRequestContext(ctx context.Context, id int) (*crawlerdb.CrawlRequest, error) {
+	cr, ok := s.crawlRequests[id]
+	if !ok {
+		return nil, errors.New("crawl request not found")
+	}
+	return cr, nil
+}
+
+func (s *fakeStore) GetCrawlRequestTasksContext(ctx context.Context, crawlRequestID int) ([]*crawlerdb.Task, error) {
+	var tasks []*crawlerdb.Task
+	for _, t := range s.tasks {
+		if t.CrawlRequestID == crawlRequestID {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+func (s *fakeStore) CreateTasksContext(ctx context.Context, tasks []*crawlerdb.Task) error {
+	for _, t := range tasks {
+		s.tasks = append(s.tasks, &crawlerdb.Task{
+			ID:             len(s.tasks) + 1,
+			CrawlRequestID: t.CrawlRequestID,
+			PageURL:        t.PageURL,
+			CurrentLevel:   t.CurrentLevel,
+			Status:         "NOT_STARTED",
+			SeenURL:        t.SeenURL,
+		})
+	}
+	return nil
+}
+
+func (s *fakeStore) ClaimTasksContext(ctx context.Context, workerID string, lease time.Duration, n int) ([]*crawlerdb.Task, error) {
+	return nil, errNotFaked
+}
+
+func (s *fakeStore) ExtendTaskLease(id int, workerID string, lease time.Duration) error {
+	return errNotFaked
+}
+
+// leased returns the task with the given id if it is in progress and leased
+// to the given worker, and crawlerdb.ErrLeaseLost otherwise.
+func (s *fakeStore) leased(id int, workerID string) (*crawlerdb.Task, error) {
+	t := s.tasks[id-1]
+	if t.Status != "IN_PROGRESS" || t.ClaimedBy != workerID {
+		return nil, crawlerdb.ErrLeaseLost
+	}
+	return t, nil
+}
+
+func (s *fakeStore) UpdateTaskStatusContext(ctx context.Context, id int, workerID string, status string) error {
+	t, err := s.leased(id, workerID)
+	if err != nil {
+		return err
+	}
+	t.Status, t.ClaimedBy = status, ""
+	return nil
+}
+
+func (s *fakeStore) UpdateTaskFinalURLContext(ctx context.Context, id int, workerID string, url string) error {
+	t, err := s.leased(id, workerID)
+	if err != nil {
+		return err
+	}
+	t.FinalURL = url
+	return nil
+}
+
+func (s *fakeStore) LinksAddedForURLContext(ctx context.Context, crawlRequestID, taskID int, url string) (bool, error) {
+	return false, nil
+}
+
+func (s *fakeStore) DeferTaskContext(ctx context.Context, id int, workerID string, until time.Time) error {
+	t, err := s.leased(id, workerID)
+	if err != nil {
+		return err
+	}
+	t.Status, t.ClaimedBy = "NOT_STARTED", ""
+	return nil
+}
+
+func (s *fakeStore) RetryTask(id int, workerID string, lastError string, until time.Time) error {
+	t, err := s.leased(id, workerID)
+	if err != nil {
+		return err
+	}
+	t.Status, t.ClaimedBy, t.Attempts, t.LastError = "RETRYING", "", t.Attempts+1, lastError
+	return nil
+}
+
+func (s *fakeStore) FailTask(id int, workerID string, lastError string) error {
+	t, err := s.leased(id, workerID)
+	if err != nil {
+		return err
+	}
+	t.Status, t.ClaimedBy, t.Attempts, t.LastError = "FAILED", "", t.Attempts+1, lastError
+	return nil
+}
+
+func (s *fakeStore) ReleaseTasks(workerID string) (int, error) {
+	return 0, errNotFaked
+}
+
+func (s *fakeStore) RecoverExpiredTasks(maxAttempts int) (int, error) {
+	return 0, errNotFaked
+}
+
+func (s *fakeStore) UpsertPageContext(ctx context.Context, url string) (int, error) {
+	for _, p := range s.pages {
+		if p.URL == url {
+			return p.ID, nil
+		}
+	}
+	s.pages = append(s.pages, &crawlerdb.Page{ID: len(s.pages) + 1, URL: url})
+	return len(s.pages), nil
+}
+
+func (s *fakeStore) GetPageContext(ctx context.Context, id int) (*crawlerdb.Page, error) {
+	p := *s.pages[id-1]
+	return &p, nil
+}
+
+func (s *fakeStore) AddRedirectEdgeContext(ctx context.Context, pageID int, url string, statusCode int) (int, error) {
+	id, _ := s.UpsertPageContext(ctx, url)
+	s.redirects = append(s.redirects, fakeRedirect{from: s.pages[pageID-1].URL, to: url, statusCode: statusCode})
+	return id, nil
+}
+
+func (s *fakeStore) UpdatePageEdgesContext(ctx context.Context, pageID int, links []crawlerdb.Link) error {
+	s.edges[pageID] = links
+	return nil
+}
+
+func (s *fakeStore) UpdatePageFetchContext(ctx context.Context, page *crawlerdb.Page) error {
+	p := *page
+	p.CrawledStatus = true
+	s.pages[page.ID-1] = &p
+	return nil
+}
+
+func (s *fakeStore) AddPageFetch(f *crawlerdb.PageFetch) error {
+	s.fetches = append(s.fetches, f)
+	return nil
+}
+
+func (s *fakeStore) AcquireHostSlotContext(ctx context.Context, host string, maxConns int, delay, ttl time.Duration) (int, time.Time, error) {
+	return 1, time.Time{}, nil
+}
+
+func (s *fakeStore) ReleaseHostSlot(id int) error { return nil }
+
+func (s *fakeStore) UpdatePageStatusContext(ctx context.Context, pageID int, statusCode int) error {
+	return nil
+}
+
+func (s *fakeStore) UpdatePageMetadataContext(ctx context.Context, pageID int, m *crawlerdb.PageMetadata) error {
+	return nil
+}
+
+func (s *fakeStore) UpdatePageContentContext(ctx context.Context, pageID int, text string, m *crawlerdb.PageMetadata) error {
+	return nil
+}
+
+func (s *fakeStore) GetEdgesForPageContext(ctx context.Context, page *crawlerdb.Page) ([]crawlerdb.Edge, error) {
+	var edges []crawlerdb.Edge
+	for _, r := range s.redirects {
+		if r.from == page.URL {
+			id, _ := s.UpsertPageContext(ctx, r.to)
+			edges = append(edges, crawlerdb.Edge{SourceID: page.ID, TargetID: id, Kind: crawlerdb.EdgeKindRedirect, StatusCode: r.statusCode})
+		}
+	}
+	for _, l := range s.edges[page.ID] {
+		id, _ := s.UpsertPageContext(ctx, l.URL)
+		edges = append(edges, crawlerdb.Edge{SourceID: page.ID, TargetID: id, Kind: l.Kind, Rel: l.Rel})
+	}
+	return edges, nil
+}
+
+func (s *fakeStore) UpdateSitemapEdgesContext(ctx context.Context, pageID int, links []crawlerdb.Link) error {
+	return errNotFaked
+}
+
+func (s *fakeStore) MergeAliasContext(ctx context.Context, aliasID, canonicalID int) error {
+	return errNotFaked
+}
+
+func (s *fakeStore) UnmergeAliasContext(ctx context.Context, aliasID int) error {
+	return errNotFaked
+}
+
+func (s *fakeStore) AddWARCRecords(records []*crawlerdb.WARCRecord) error {
+	return errNotFaked
+}
+
+func (s *fakeStore) Close() error { return nil }
+
+func (s *fakeStore) FindDuplicatePageContext(ctx context.Context, page *crawlerdb.Page) (int, error) {
+	return s.duplicates[page.ContentHash], nil
+}
+
+// fakeSite is a Fetcher serving a fixed set of responses by url, and 404s for
+// everything else.
+type fakeSite map[string]*http.Response
+
+func (f fakeSite) Do(req *http.Request) (*http.Response, error) {
+	resp, ok := f[req.URL.String()]
+	if !ok {
+		resp = &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}
+	}
+	return resp, nil
+}
+
+func htmlResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func redirectResponse(statusCode int, location string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"Location": []string{location}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+}
+
+// blockingFetcher is a Fetcher whose requests only return once they are
+// cancelled.
+type blockingFetcher struct{}
+
+func (blockingFetcher) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func newTestCrawler(db store, fetcher Fetcher) *GraphCrawler {
+	c := &GraphCrawler{
+		cfg: Config{
+			Canonicalizer: &urlcanon.Canonicalizer{},
+			Fetcher:       fetcher,
+			MaxRedirects:  10,
+			MaxBodySize:   1 << 20,
+			Retry: RetryPolicy{
+				MaxAttempts:  2,
+				BaseDelay:    time.Second,
+				MaxDelay:     time.Second,
+				ErrorClasses: DefaultRetryErrorClasses,
+				StatusCodes:  DefaultRetryStatusCodes,
+			},
+			WorkerID:    "worker",
+			TaskTimeout: time.Minute,
+		},
+		db:  db,
+		ctx: context.Background(),
+	}
+	c.robots = newRobotsCache(fetcher, c.waitForHostSlot)
+	return c
+}
+
+func TestCrawlPage(t *testing.T) {
+	t.Run("successfully follows redirects and finds the links of the page they end up at", func(tt *testing.T) {
+		db := newFakeStore()
+		c := newTestCrawler(db, fakeSite{
+			"http://example.com/old":   redirectResponse(http.StatusMovedPermanently, "/moved"),
+			"http://example.com/moved": redirectResponse(http.StatusFound, "http://example.com/new"),
+			"http://example.com/new":   htmlResponse(`<html><body><a href="/about">about</a><a href="https://other.com/page#top">other</a><img src="/logo.png"></body></html>`),
+		})
+		id, _ := db.UpsertPageContext(context.Background(), "http://example.com/old")
+		page, _ := db.GetPageContext(context.Background(), id)
+
+		page, links, err := c.crawlPage(context.Background(), page, &crawlerdb.CrawlRequest{ID: 1, Levels: 2})
+		assert.NoError(tt, err)
+		assert.Equal(tt, "http://example.com/new", page.URL)
+		assert.Equal(tt, []fakeRedirect{
+			{from: "http://example.com/old", to: "http://example.com/moved", statusCode: http.StatusMovedPermanently},
+			{from: "http://example.com/moved", to: "http://example.com/new", statusCode: http.StatusFound},
+		}, db.redirects)
+		assert.Equal(tt, []crawlerdb.Link{
+			{URL: "http://example.com/about", Kind: crawlerdb.EdgeKindNavigation},
+			{URL: "https://other.com/page", Kind: crawlerdb.EdgeKindNavigation},
+			{URL: "http://example.com/logo.png", Kind: crawlerdb.EdgeKindResource},
+		}, links)
+		assert.Equal(tt, links, db.edges[page.ID])
+	})
+
+	t.Run("successfully leaves out the edges of a duplicate whose original's links are reused", func(tt *testing.T) {
+		body := `<html><body><p>same text</p><a href="/about">about</a></body></html>`
+		db := newFakeStore()
+		c := newTestCrawler(db, fakeSite{"http://example.com/copy": htmlResponse(body)})
+		hash, _ := fingerprint(textWords(collapseSpace(parseHTML(strings.NewReader(body)).text.String())))
+		db.duplicates = map[string]int{hash: 42}
+		id, _ := db.UpsertPageContext(context.Background(), "http://example.com/copy")
+		page, _ := db.GetPageContext(context.Background(), id)
+
+		page, links, err := c.crawlPage(context.Background(), page, &crawlerdb.CrawlRequest{ID: 1, Levels: 2, CrawlOptions: crawlerdb.CrawlOptions{ReuseDuplicates: true}})
+		assert.NoError(tt, err)
+		assert.Equal(tt, 42, page.DuplicateOf)
+		assert.Empty(tt, links)
+		assert.Empty(tt, db.edges[page.ID])
+
+		// without reuse_duplicates the duplicate's own links are recorded
+		c = newTestCrawler(db, fakeSite{"http://example.com/copy": htmlResponse(body)})
+		page, links, err = c.crawlPage(context.Background(), page, &crawlerdb.CrawlRequest{ID: 1, Levels: 2})
+		assert.NoError(tt, err)
+		assert.Equal(tt, 42, page.DuplicateOf)
+		assert.Len(tt, links, 1)
+		assert.Equal(tt, links, db.edges[page.ID])
+	})
+
+	t.Run("successfully skips pages disallowed by robots.txt", func(tt *testing.T) {
+		db := newFakeStore()
+		c := newTestCrawler(db, fakeSite{
+			"http://example.com/robots.txt": htmlResponse("User-agent: *\nDisallow: /private"),
+		})
+		id, _ := db.UpsertPageContext(context.Background(), "http://example.com/private/page")
+		page, _ := db.GetPageContext(context.Background(), id)
+
+		_, links, err := c.crawlPage(context.Background(), page, &crawlerdb.CrawlRequest{ID: 1, Levels: 2})
+		assert.Equal(tt, errBlockedByRobots, err)
+		assert.Empty(tt, links)
+		assert.Empty(tt, db.edges)
+	})
+}
+
+// newTestTask adds a crawl request for url with the given number of levels that
+// follows navigation links to db, along with its first task leased to the test
+// crawler's worker.
+func newTestTask(db *fakeStore, url string, levels int) *crawlerdb.Task {
+	db.crawlRequests[1] = &crawlerdb.CrawlRequest{ID: 1, URL: url, Levels: levels, CrawlOptions: crawlerdb.CrawlOptions{FollowKinds: []string{crawlerdb.EdgeKindNavigation}}}
+	db.CreateTasksContext(context.Background(), []*crawlerdb.Task{{CrawlRequestID: 1, PageURL: url}})
+	t := db.tasks[len(db.tasks)-1]
+	t.Status, t.ClaimedBy = "IN_PROGRESS", "worker"
+	return t
+}
+
+func TestRun(t *testing.T) {
+	t.Run("successfully completes a task and adds tasks for the links of its page", func(tt *testing.T) {
+		db := newFakeStore()
+		c := newTestCrawler(db, fakeSite{
+			"http://example.com/": htmlResponse(`<html><body><a href="/about">about</a><a href="/">home</a></body></html>`),
+		})
+		task := newTestTask(db, "http://example.com/", 2)
+
+		c.run(task, nil)
+		assert.Equal(tt, "COMPLETED", db.tasks[0].Status)
+		assert.Empty(tt, db.tasks[0].ClaimedBy)
+		assert.Equal(tt, []*crawlerdb.Task{
+			{ID: 2, CrawlRequestID: 1, PageURL: "http://example.com/about", CurrentLevel: 1, Status: "NOT_STARTED"},
+			{ID: 3, CrawlRequestID: 1, PageURL: "http://example.com/", CurrentLevel: 1, Status: "NOT_STARTED", SeenURL: true},
+		}, db.tasks[1:])
+	})
+
+	t.Run("successfully retries a task that failed with a transient error until it runs out of attempts", func(tt *testing.T) {
+		db := newFakeStore()
+		unavailable := func() *http.Response {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader(""))}
+		}
+		c := newTestCrawler(db, fakeSite{"http://example.com/": unavailable()})
+		task := newTestTask(db, "http://example.com/", 2)
+
+		c.run(task, nil)
+		assert.Equal(tt, "RETRYING", db.tasks[0].Status)
+		assert.Equal(tt, 1, db.tasks[0].Attempts)
+		assert.NotEmpty(tt, db.tasks[0].LastError)
+		assert.Len(tt, db.tasks, 1)
+
+		// the second attempt is the last one the retry policy allows
+		c = newTestCrawler(db, fakeSite{"http://example.com/": unavailable()})
+		task.Status, task.ClaimedBy = "IN_PROGRESS", "worker"
+		c.run(task, nil)
+		assert.Equal(tt, "FAILED", db.tasks[0].Status)
+		assert.Equal(tt, 2, db.tasks[0].Attempts)
+		assert.Len(tt, db.tasks, 1)
+	})
+
+	t.Run("successfully leaves a task alone once its lease is lost", func(tt *testing.T) {
+		db := newFakeStore()
+		c := newTestCrawler(db, blockingFetcher{})
+		task := newTestTask(db, "http://example.com/", 2)
+		leaseLost := make(chan struct{})
+		close(leaseLost)
+
+		c.run(task, leaseLost)
+		assert.Equal(tt, "IN_PROGRESS", db.tasks[0].Status)
+		assert.Equal(tt, "worker", db.tasks[0].ClaimedBy)
+		assert.Equal(tt, 0, db.tasks[0].Attempts)
+		assert.Len(tt, db.tasks, 1)
+
+		// another worker claimed the task in the meantime, so it isn't
+		// completed by this one
+		c = newTestCrawler(db, fakeSite{"http://example.com/": htmlResponse(`<html><body><a href="/about">about</a></body></html>`)})
+		task.ClaimedBy = "other"
+		c.run(task, nil)
+		assert.Equal(tt, "IN_PROGRESS", db.tasks[0].Status)
+		assert.Equal(tt, "other", db.tasks[0].ClaimedBy)
+		assert.Equal(tt, 0, db.tasks[0].Attempts)
+	})
+}
@@ -0,0 +1,133 @@
+package graphcrawler
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultUserAgent is the User-Agent header sent with every request, unless
+// another one is configured.
+const defaultUserAgent = robotsUserAgent + "/1.0 (+https://github.com/emilyzhang/crawlr)"
+
+// Fetcher makes http requests on behalf of the crawler. Implementations must
+// not follow redirects, since the crawler follows and records them itself.
+// Tests can replace the default HTTPFetcher with an in-memory fake.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// FetcherFunc is an adapter to allow the use of ordinary functions as
+// Fetchers.
+type FetcherFunc func(req *http.Request) (*http.Response, error)
+
+// Do calls f(req).
+func (f FetcherFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// FetcherConfig represents the configuration of an HTTPFetcher. Zero values
+// are replaced with sensible defaults.
+type FetcherConfig struct {
+	// UserAgent is the User-Agent header sent with every request.
+	UserAgent string
+	// Header holds extra headers sent with every request.
+	Header http.Header
+	// Timeout is the maximum amount of time a single request may take,
+	// including reading the response body.
+	Timeout time.Duration
+	// DialTimeout is the maximum amount of time spent connecting to a host.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the maximum amount of time spent on a TLS
+	// handshake.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout is the maximum amount of time spent waiting for a
+	// response's headers after sending the request.
+	ResponseHeaderTimeout time.Duration
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept open
+	// to a single host.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open.
+	IdleConnTimeout time.Duration
+}
+
+// HTTPFetcher is the default Fetcher, which shares a single http.Transport
+// (and so its pool of connections) between every request the crawler makes.
+type HTTPFetcher struct {
+	client    *http.Client
+	userAgent string
+	header    http.Header
+}
+
+// NewHTTPFetcher creates a new HTTPFetcher with the given configuration.
+func NewHTTPFetcher(cfg FetcherConfig) *HTTPFetcher {
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaultUserAgent
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = requestTimeout
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = 30 * time.Second
+	}
+	if cfg.TLSHandshakeTimeout == 0 {
+		cfg.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if cfg.ResponseHeaderTimeout == 0 {
+		cfg.ResponseHeaderTimeout = time.Minute
+	}
+	if cfg.MaxIdleConnsPerHost == 0 {
+		cfg.MaxIdleConnsPerHost = 4
+	}
+	if cfg.IdleConnTimeout == 0 {
+		cfg.IdleConnTimeout = 90 * time.Second
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		// a custom dialer turns off http/2 unless it's asked for explicitly
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &HTTPFetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			// the crawler follows redirects itself, so it can record every hop
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		userAgent: cfg.UserAgent,
+		header:    cfg.Header,
+	}
+}
+
+// Timeout returns the maximum amount of time a single request may take.
+func (f *HTTPFetcher) Timeout() time.Duration {
+	return f.client.Timeout
+}
+
+// Do sends a request, along with the configured User-Agent and headers.
+// Headers already set on the request take precedence over the configured
+// ones.
+func (f *HTTPFetcher) Do(req *http.Request) (*http.Response, error) {
+	for k, v := range f.header {
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = v
+		}
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	return f.client.Do(req)
+}
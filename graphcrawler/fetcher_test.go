@@ -0,0 +1,45 @@
+package graphcrawler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-User-Agent", req.UserAgent())
+		w.Header().Set("X-Accept-Language", req.Header.Get("Accept-Language"))
+		if req.URL.Path == "/old" {
+			http.Redirect(w, req, "/new", http.StatusMovedPermanently)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("successfully sends the configured user-agent and headers", func(tt *testing.T) {
+		f := NewHTTPFetcher(FetcherConfig{Header: http.Header{"Accept-Language": []string{"en"}}})
+		resp, err := getRequest(context.Background(), f, server.URL, nil)
+		assert.NoError(tt, err)
+		resp.Body.Close()
+		assert.Equal(tt, defaultUserAgent, resp.Header.Get("X-User-Agent"))
+		assert.Equal(tt, "en", resp.Header.Get("X-Accept-Language"))
+
+		f = NewHTTPFetcher(FetcherConfig{UserAgent: "otherbot/2.0"})
+		resp, err = getRequest(context.Background(), f, server.URL, http.Header{"Accept-Language": []string{"fr"}})
+		assert.NoError(tt, err)
+		resp.Body.Close()
+		assert.Equal(tt, "otherbot/2.0", resp.Header.Get("X-User-Agent"))
+		assert.Equal(tt, "fr", resp.Header.Get("X-Accept-Language"))
+	})
+
+	t.Run("successfully returns redirects without following them", func(tt *testing.T) {
+		resp, err := getRequest(context.Background(), NewHTTPFetcher(FetcherConfig{}), server.URL+"/old", nil)
+		assert.NoError(tt, err)
+		resp.Body.Close()
+		assert.True(tt, isRedirect(resp))
+		assert.Equal(tt, "/new", resp.Header.Get("Location"))
+	})
+}
@@ -0,0 +1,218 @@
+package graphcrawler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/urlcanon"
+)
+
+// loggedHeaders are the response headers recorded for every fetch.
+var loggedHeaders = []string{
+	"Cache-Control",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+	"Location",
+	"Retry-After",
+	"Server",
+	"X-Robots-Tag",
+}
+
+// crawlRequestKey is the context key of the id of the crawl request a request
+// is made for.
+type crawlRequestKey struct{}
+
+// withCrawlRequest returns a copy of ctx, under which fetches are recorded as
+// made for the crawl request with the given id.
+func withCrawlRequest(ctx context.Context, crawlRequestID int) context.Context {
+	return context.WithValue(ctx, crawlRequestKey{}, crawlRequestID)
+}
+
+// loggingFetcher wraps a Fetcher, tracing every request and recording it in
+// the database once its response body is closed (or right away if the request
+// fails). Requests are recorded under their canonical url, so that they're
+// found for a page node whichever spelling of its url was requested.
+type loggingFetcher struct {
+	Fetcher
+	db            store
+	canonicalizer *urlcanon.Canonicalizer
+}
+
+// fetchTrace collects the timing breakdown of a single request.
+type fetchTrace struct {
+	mu                      sync.Mutex
+	start                   time.Time
+	dnsStart, connectStart  time.Time
+	tlsStart                time.Time
+	dns, connect, tls, ttfb time.Duration
+}
+
+// clientTrace returns the httptrace hooks that fill in the trace.
+func (ft *fetchTrace) clientTrace() *httptrace.ClientTrace {
+	since := func(start time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return time.Since(start)
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			ft.mu.Lock()
+			ft.dnsStart = time.Now()
+			ft.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			ft.mu.Lock()
+			ft.dns = since(ft.dnsStart)
+			ft.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			ft.mu.Lock()
+			ft.connectStart = time.Now()
+			ft.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			ft.mu.Lock()
+			ft.connect = since(ft.connectStart)
+			ft.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			ft.mu.Lock()
+			ft.tlsStart = time.Now()
+			ft.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			ft.mu.Lock()
+			ft.tls = since(ft.tlsStart)
+			ft.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			ft.mu.Lock()
+			ft.ttfb = since(ft.start)
+			ft.mu.Unlock()
+		},
+	}
+}
+
+// Do sends a request using the wrapped Fetcher, tracing and recording it.
+func (f *loggingFetcher) Do(req *http.Request) (*http.Response, error) {
+	ft := &fetchTrace{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), ft.clientTrace()))
+	crawlRequestID, _ := req.Context().Value(crawlRequestKey{}).(int)
+	pf := &crawlerdb.PageFetch{CrawlRequestID: crawlRequestID, URL: req.URL.String()}
+	pf.CanonicalURL, _ = f.canonicalizer.Canonicalize(pf.URL)
+
+	resp, err := f.Fetcher.Do(req)
+	if err != nil {
+		pf.ErrorClass = errorClass(err)
+		f.record(pf, ft)
+		return resp, err
+	}
+	pf.StatusCode = resp.StatusCode
+	pf.FinalURL = pf.URL
+	if resp.Request != nil {
+		pf.FinalURL = resp.Request.URL.String()
+	}
+	if isRedirect(resp) {
+		if location, err := redirectLocation(resp, pf.URL); err == nil {
+			pf.FinalURL = location
+		}
+	}
+	pf.ContentType = resp.Header.Get("Content-Type")
+	pf.Header = make(map[string]string)
+	for _, h := range loggedHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			pf.Header[h] = v
+		}
+	}
+	if resp.StatusCode >= 500 {
+		pf.ErrorClass = "http_5xx"
+	} else if resp.StatusCode >= 400 {
+		pf.ErrorClass = "http_4xx"
+	}
+	resp.Body = &loggedBody{ReadCloser: resp.Body, record: func(n int64, err error) {
+		pf.Bytes = n
+		if err != nil && pf.ErrorClass == "" {
+			pf.ErrorClass = "body"
+			if c := errorClass(err); c == "timeout" {
+				pf.ErrorClass = c
+			}
+		}
+		f.record(pf, ft)
+	}}
+	return resp, nil
+}
+
+// record fills in the timing breakdown of a fetch and saves it.
+func (f *loggingFetcher) record(pf *crawlerdb.PageFetch, ft *fetchTrace) {
+	ft.mu.Lock()
+	pf.DNS, pf.Connect, pf.TLS, pf.TTFB = ft.dns, ft.connect, ft.tls, ft.ttfb
+	ft.mu.Unlock()
+	pf.Total = time.Since(ft.start)
+	if err := f.db.AddPageFetch(pf); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// loggedBody wraps a response body, counting the bytes read from it and
+// calling record once it is closed.
+type loggedBody struct {
+	io.ReadCloser
+	n      int64
+	err    error
+	record func(n int64, err error)
+	once   sync.Once
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.record(b.n, b.err) })
+	return err
+}
+
+// errorClass classifies why a request failed.
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &hostnameErr), errors.As(err, &authorityErr), errors.As(err, &certErr), errors.As(err, &recordErr):
+		return "tls"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	}
+	return "other"
+}
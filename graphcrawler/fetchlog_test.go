@@ -0,0 +1,60 @@
+package graphcrawler
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/emilyzhang/crawlr/urlcanon"
+	"github.com/stretchr/testify/assert"
+)
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestFetchLog(t *testing.T) {
+	t.Run("successfully classifies request errors", func(tt *testing.T) {
+		wrap := func(err error) error {
+			return &url.Error{Op: "Get", URL: "http://example.com/", Err: err}
+		}
+		assert.Equal(tt, "dns", errorClass(wrap(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.com"}})))
+		assert.Equal(tt, "timeout", errorClass(wrap(&net.OpError{Op: "read", Err: timeoutError{}})))
+		assert.Equal(tt, "connect", errorClass(wrap(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})))
+		assert.Equal(tt, "tls", errorClass(wrap(x509.UnknownAuthorityError{})))
+		assert.Equal(tt, "reset", errorClass(wrap(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)})))
+		assert.Equal(tt, "reset", errorClass(wrap(io.EOF)))
+		assert.Equal(tt, "other", errorClass(errors.New("something else")))
+	})
+
+	t.Run("successfully records fetches under their canonical url once the body is closed", func(tt *testing.T) {
+		db := newFakeStore()
+		f := &loggingFetcher{
+			Fetcher:       fakeSite{"http://Example.com:80/a?b=1&a=2": htmlResponse("<html></html>")},
+			db:            db,
+			canonicalizer: &urlcanon.Canonicalizer{},
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://Example.com:80/a?b=1&a=2", nil)
+		resp, err := f.Do(req.WithContext(withCrawlRequest(req.Context(), 3)))
+		assert.NoError(tt, err)
+		assert.Empty(tt, db.fetches)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Len(tt, db.fetches, 1)
+		assert.Equal(tt, 3, db.fetches[0].CrawlRequestID)
+		assert.Equal(tt, "http://Example.com:80/a?b=1&a=2", db.fetches[0].URL)
+		assert.Equal(tt, "http://example.com/a?a=2&b=1", db.fetches[0].CanonicalURL)
+		assert.Equal(tt, int64(len("<html></html>")), db.fetches[0].Bytes)
+	})
+}
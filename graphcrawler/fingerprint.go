@@ -0,0 +1,66 @@
+package graphcrawler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// shingleSize is the number of consecutive words hashed together as a single
+// feature of a page's simhash.
+const shingleSize = 3
+
+// textWords splits the visible text of a page into lowercase words, ignoring
+// punctuation and whitespace.
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// fingerprint returns the fingerprint of the words of a page: a hash of the
+// words, which only matches for pages with exactly the same text, and a
+// simhash of the words, which only differs in a few bits for pages with nearly
+// the same text. The hash is empty for pages without any words.
+func fingerprint(words []string) (string, uint64) {
+	if len(words) == 0 {
+		return "", 0
+	}
+	sum := sha256.Sum256([]byte(strings.Join(words, " ")))
+	return hex.EncodeToString(sum[:]), simhash(words)
+}
+
+// simhash computes the 64 bit simhash of a list of words, using overlapping
+// shingles of shingleSize words as its features.
+func simhash(words []string) uint64 {
+	var weights [64]int
+	n := len(words) - shingleSize + 1
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		end := i + shingleSize
+		if end > len(words) {
+			end = len(words)
+		}
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:end], " ")))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<uint(bit)) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, w := range weights {
+		if w > 0 {
+			hash |= 1 << uint(bit)
+		}
+	}
+	return hash
+}
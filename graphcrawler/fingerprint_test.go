@@ -0,0 +1,51 @@
+package graphcrawler
+
+import (
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	article := `Web crawlers discover pages by following the links on pages they have already
+		fetched, starting from a handful of seed urls. Every fetched page is parsed for links, which are
+		resolved against the page's url, canonicalized and added to a queue of pages still to visit. A
+		polite crawler limits how often it requests pages from a single host, honours the rules in the
+		host's robots.txt file, and identifies itself with a descriptive user agent. Because many sites
+		serve the same content under several urls, for example with session ids in query strings or as
+		printer friendly versions, crawlers also fingerprint the text of every page so that duplicates
+		can be recognised and skipped instead of wasting the crawl budget on them.`
+
+	t.Run("successfully collects only the visible text of a page", func(tt *testing.T) {
+		doc := parseHTML(strings.NewReader(`<html><head><title>Hello</title><style>p { color: red; }</style></head>
+			<body><p>Hello, <b>world</b>!</p><script>var x = "<p>hidden</p>";</script><noscript>enable js</noscript></body></html>`))
+		assert.Equal(tt, []string{"Hello", "Hello,", "world", "!"}, strings.Fields(doc.text.String()))
+	})
+
+	t.Run("successfully ignores markup, case and whitespace in exact duplicates", func(tt *testing.T) {
+		a := parseHTML(strings.NewReader(`<body><a href="/a?sid=1">Home</a><p>` + article + `</p></body>`))
+		b := parseHTML(strings.NewReader(`<body class="print"><a href="/a?sid=2">home</a>  <div>` + article + `</div><script>track()</script></body>`))
+		hashA, simhashA := fingerprint(textWords(a.text.String()))
+		hashB, simhashB := fingerprint(textWords(b.text.String()))
+		assert.NotEmpty(tt, hashA)
+		assert.Equal(tt, hashA, hashB)
+		assert.Equal(tt, simhashA, simhashB)
+	})
+
+	t.Run("successfully gives near duplicates close simhashes", func(tt *testing.T) {
+		hashA, simhashA := fingerprint(textWords(article + " posted on monday"))
+		hashB, simhashB := fingerprint(textWords(article + " posted on tuesday"))
+		_, simhashC := fingerprint(textWords("Our bakery opens at seven every morning and sells sourdough loaves, croissants, cinnamon rolls and seasonal fruit tarts made fresh on the premises by a small team of bakers."))
+		assert.NotEqual(tt, hashA, hashB)
+		assert.True(tt, bits.OnesCount64(simhashA^simhashB) < 8)
+		assert.True(tt, bits.OnesCount64(simhashA^simhashC) > 16)
+	})
+
+	t.Run("successfully leaves pages without text unfingerprinted", func(tt *testing.T) {
+		hash, simhash := fingerprint(textWords(" \n ... "))
+		assert.Empty(tt, hash)
+		assert.Zero(tt, simhash)
+	})
+}
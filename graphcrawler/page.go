@@ -1,66 +1,468 @@
 package graphcrawler
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/urlcanon"
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 )
 
-// getRequest returns an *http.Response for a given url.
-func getRequest(url string) (*http.Response, error) {
-	cl := http.Client{Timeout: 2 * time.Minute}
-	resp, err := cl.Get(url)
+const (
+	// requestTimeout is the default maximum amount of time a single request
+	// may take, and how long a host connection slot is held at most.
+	requestTimeout = 2 * time.Minute
+	// sniffLen is the number of bytes used to sniff the media type of a
+	// response that doesn't specify one.
+	sniffLen = 512
+)
+
+// redirect represents a single hop in a redirect chain.
+type redirect struct {
+	url        string
+	statusCode int
+	location   string
+}
+
+// releaseOnClose wraps a response body, calling release once the body is
+// closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// statusError is returned when a page responds with a status code the crawler
+// can't do anything with.
+type statusError struct {
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Received a non-200 status code: %d", e.statusCode)
+}
+
+// getRequest returns an *http.Response for a given url using the given
+// fetcher, sending the given headers along with the request. Redirects are not
+// followed, and are returned as is, as are 304 Not Modified responses to
+// conditional requests.
+func getRequest(ctx context.Context, f Fetcher, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := f.Do(req)
 	if err != nil {
 		return resp, err
-	} else if resp.StatusCode != 200 {
-		// for now, this ignores redirects & other possible non-error http
-		// status codes
-		return resp, fmt.Errorf("Received a non-200 status code: %d", resp.StatusCode)
+	} else if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotModified && !isRedirect(resp) {
+		// for now, this ignores other possible non-error http status codes
+		resp.Body.Close()
+		return resp, &statusError{statusCode: resp.StatusCode}
 	}
 	return resp, nil
 }
 
-// findRawURLs uses an html parser to find links from html tags.
-func findRawURLs(resp *http.Response) []string {
+// isRedirect reports whether a response redirects to another url.
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	}
+	return false
+}
+
+// redirectLocation returns the absolute url a redirect response points to,
+// without its fragment.
+func redirectLocation(resp *http.Response, refURL string) (string, error) {
+	location := resp.Header.Get("Location")
+	ref, err := url.Parse(refURL)
+	if err != nil {
+		return "", err
+	}
+	u, err := ref.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse redirect location %s: %v", location, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Redirect to unsupported url %s", location)
+	}
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// htmlMediaTypes are the media types of pages that are parsed for links.
+var htmlMediaTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+}
+
+// readHTML reads and closes the body of a response, recording the media type
+// and size of the body on the given page. The media type is sniffed from the
+// start of the body if the response doesn't specify one. Only html bodies are
+// downloaded, up to maxSize bytes, and returned transcoded to utf-8, along with
+// their character set being recorded on the page; the download is aborted and
+// a nil body is returned for any other media type.
+func readHTML(resp *http.Response, page *crawlerdb.Page, maxSize int64) ([]byte, error) {
 	defer resp.Body.Close()
-	var paths []string
+	r := bufio.NewReaderSize(resp.Body, sniffLen)
+	page.ContentLength = resp.ContentLength
+	page.MediaType = ""
+	page.Charset = ""
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, err := mime.ParseMediaType(ct); err == nil {
+			page.MediaType = mediaType
+		}
+	}
+	if page.MediaType == "" {
+		// the response doesn't say what it is, so sniff the start of the body
+		peek, err := r.Peek(sniffLen)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		page.MediaType, _, _ = mime.ParseMediaType(http.DetectContentType(peek))
+	}
+	if !htmlMediaTypes[page.MediaType] {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxSize))
+	if err != nil {
+		return nil, err
+	}
+	if page.ContentLength < 0 {
+		page.ContentLength = int64(len(body))
+	}
+	body, page.Charset = decodeHTML(body, resp.Header.Get("Content-Type"))
+	return body, nil
+}
+
+// decodeHTML transcodes an html body to utf-8, detecting its character set
+// from the Content-Type header, a byte order mark or a <meta charset> tag, and
+// returns the transcoded body along with the name of the character set.
+func decodeHTML(body []byte, contentType string) ([]byte, string) {
+	e, name, certain := charset.DetermineEncoding(body, contentType)
+	// windows-1252 is also the fallback when nothing declares a character
+	// set, in which case an undeclared utf-8 body is far more likely
+	if !certain && name == "windows-1252" && utf8.Valid(body) {
+		return body, "utf-8"
+	}
+	if name == "utf-8" {
+		return body, name
+	}
+	decoded, err := e.NewDecoder().Bytes(body)
+	if err != nil {
+		fmt.Printf("Unable to decode page from %s: %v\n", name, err)
+		return body, name
+	}
+	return decoded, name
+}
+
+// linkAttrs maps html tags to the attribute holding the url they link to, and
+// the kind of edge that link represents.
+var linkAttrs = map[string]struct {
+	attr string
+	kind string
+}{
+	"a":      {"href", crawlerdb.EdgeKindNavigation},
+	"area":   {"href", crawlerdb.EdgeKindNavigation},
+	"link":   {"href", crawlerdb.EdgeKindResource},
+	"img":    {"src", crawlerdb.EdgeKindResource},
+	"script": {"src", crawlerdb.EdgeKindResource},
+	"iframe": {"src", crawlerdb.EdgeKindEmbed},
+	"form":   {"action", crawlerdb.EdgeKindForm},
+}
+
+// document represents the parts of an html page the crawler cares about.
+type document struct {
+	// base is the url in the page's <base href> tag, if it has one.
+	base string
+	// canonical is the url in the page's <link rel="canonical"> tag, if it
+	// has one.
+	canonical string
+	links     []crawlerdb.Link
+	// noindex and nofollow are set by a robots meta tag, asking for the page
+	// not to be indexed and for its links not to be followed.
+	noindex  bool
+	nofollow bool
+	// text is the visible text of the page, leaving out scripts and styles.
+	text strings.Builder
+	// metadata is what the page says about itself, apart from its word count.
+	metadata crawlerdb.PageMetadata
+}
+
+// invisibleTags are the html tags whose contents aren't part of the visible
+// text of a page.
+var invisibleTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+}
+
+// parseHTML uses an html parser to find links from html tags, along with the
+// kind of edge each link represents and its rel attribute, and collects the
+// visible text and metadata of the page.
+func parseHTML(r io.Reader) *document {
+	doc := &document{}
+	doc.metadata.OpenGraph = make(map[string]string)
+	doc.metadata.Twitter = make(map[string]string)
 	done := false
-	tokenizer := html.NewTokenizer(resp.Body)
+	// invisible is the invisible tag the tokenizer is currently inside of
+	var invisible string
+	// only the first <title> counts, the text of every <h1> is collected
+	var inTitle, titleDone, inH1 bool
+	var title, h1 strings.Builder
+	tokenizer := html.NewTokenizer(r)
 	for !done {
 		t := tokenizer.Next()
 		switch t {
 		case html.ErrorToken:
 			done = true
-		case html.StartTagToken:
+		case html.TextToken:
+			text := tokenizer.Text()
+			if invisible == "" {
+				doc.text.Write(text)
+				doc.text.WriteByte(' ')
+			}
+			if inTitle {
+				title.Write(text)
+			}
+			if inH1 && invisible == "" {
+				h1.Write(text)
+				h1.WriteByte(' ')
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == invisible {
+				invisible = ""
+			}
+			switch string(name) {
+			case "title":
+				if inTitle {
+					doc.metadata.Title = collapseSpace(title.String())
+					inTitle, titleDone = false, true
+				}
+			case "h1":
+				if inH1 {
+					if v := collapseSpace(h1.String()); v != "" {
+						doc.metadata.H1s = append(doc.metadata.H1s, v)
+					}
+					inH1 = false
+				}
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
 			token := tokenizer.Token()
-			// at this time it ignores all other types of tags
-			if token.Data == "a" {
-				for _, a := range token.Attr {
-					if a.Key == "href" {
-						paths = append(paths, a.Val)
-						break
+			if t == html.StartTagToken && invisible == "" && invisibleTags[token.Data] {
+				invisible = token.Data
+			}
+			attrs := make(map[string]string)
+			for _, a := range token.Attr {
+				if _, ok := attrs[a.Key]; !ok {
+					attrs[a.Key] = a.Val
+				}
+			}
+			rel := strings.Join(strings.Fields(strings.ToLower(attrs["rel"])), " ")
+			if la, ok := linkAttrs[token.Data]; ok {
+				if v, ok := attrs[la.attr]; ok && v != "" {
+					doc.links = append(doc.links, crawlerdb.Link{URL: v, Kind: la.kind, Rel: rel})
+				}
+			}
+			switch token.Data {
+			case "html":
+				if doc.metadata.Lang == "" {
+					doc.metadata.Lang = strings.TrimSpace(attrs["lang"])
+				}
+			case "title":
+				if t == html.StartTagToken && !titleDone {
+					inTitle = true
+				}
+			case "h1":
+				if t == html.StartTagToken {
+					inH1 = true
+					h1.Reset()
+				}
+			case "base":
+				// only the first <base href> counts
+				if doc.base == "" {
+					doc.base = attrs["href"]
+				}
+			case "link":
+				// only the first rel=canonical counts
+				if doc.canonical == "" && hasRel(rel, "canonical") {
+					doc.canonical = attrs["href"]
+				}
+			case "img":
+				for _, v := range parseSrcset(attrs["srcset"]) {
+					doc.links = append(doc.links, crawlerdb.Link{URL: v, Kind: crawlerdb.EdgeKindResource})
+				}
+			case "meta":
+				name := strings.ToLower(attrs["name"])
+				if name == "robots" || name == robotsUserAgent {
+					noindex, nofollow := parseRobotsDirectives(attrs["content"])
+					doc.noindex = doc.noindex || noindex
+					doc.nofollow = doc.nofollow || nofollow
+				}
+				doc.addMetaTag(name, strings.ToLower(attrs["property"]), collapseSpace(attrs["content"]))
+				if strings.EqualFold(attrs["http-equiv"], "refresh") {
+					if v := refreshURL(attrs["content"]); v != "" {
+						doc.links = append(doc.links, crawlerdb.Link{URL: v, Kind: crawlerdb.EdgeKindRefresh})
 					}
 				}
 			}
 		}
 	}
-	return paths
+	if inTitle {
+		doc.metadata.Title = collapseSpace(title.String())
+	}
+	return doc
+}
+
+// addMetaTag records the content of a <meta> tag with the given name or
+// property if it's the page's description, or one of its OpenGraph or Twitter
+// card fields. Only the first tag for each field counts.
+func (doc *document) addMetaTag(name, property, content string) {
+	if name == "description" && doc.metadata.Description == "" {
+		doc.metadata.Description = content
+	}
+	// OpenGraph tags are supposed to use property and Twitter tags name, but
+	// plenty of pages mix them up
+	for _, key := range []string{property, name} {
+		fields, field := doc.metadata.OpenGraph, strings.TrimPrefix(key, "og:")
+		if strings.HasPrefix(key, "twitter:") {
+			fields, field = doc.metadata.Twitter, strings.TrimPrefix(key, "twitter:")
+		} else if !strings.HasPrefix(key, "og:") {
+			continue
+		}
+		if _, ok := fields[field]; !ok && field != "" {
+			fields[field] = content
+		}
+	}
+}
+
+// collapseSpace trims a string and collapses every run of whitespace in it
+// into a single space.
+func collapseSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
 }
 
-// filterURLs filters through a slice of strings representing urls, removing any
-// urls that can't be parsed or don't have the proper protocols.
-func filterURLs(links []string, refURL string) ([]string, error) {
+// baseURL returns the url that relative links on a page are resolved against,
+// which is the page's <base href> resolved against the page's url, or just the
+// page's url if the page has no (valid) <base href>.
+func (doc *document) baseURL(pageURL string) string {
+	if doc.base == "" {
+		return pageURL
+	}
+	ref, err := url.Parse(pageURL)
+	if err != nil {
+		return pageURL
+	}
+	base, err := ref.Parse(doc.base)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return pageURL
+	}
+	return base.String()
+}
+
+// canonicalURL returns the canonical form of the page's rel=canonical url
+// resolved against the page's base url, or an empty string if the page has no
+// (valid) rel=canonical.
+func (doc *document) canonicalURL(pageURL string, canon *urlcanon.Canonicalizer) string {
+	if doc.canonical == "" {
+		return ""
+	}
+	links, err := filterURLs([]crawlerdb.Link{{URL: doc.canonical}}, doc.baseURL(pageURL), canon)
+	if err != nil || len(links) == 0 {
+		return ""
+	}
+	return links[0].URL
+}
+
+// hasRel reports whether a normalized rel attribute contains the given value.
+func hasRel(rel, value string) bool {
+	for _, r := range strings.Fields(rel) {
+		if r == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isNofollow reports whether a rel attribute asks for a link not to be
+// followed, which is the case for nofollow, ugc and sponsored links.
+func isNofollow(rel string) bool {
+	for _, r := range strings.Fields(rel) {
+		if r == "nofollow" || r == "ugc" || r == "sponsored" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSrcset returns the urls of the image candidates in an srcset attribute,
+// such as "small.png 1x, large.png 2x".
+func parseSrcset(srcset string) []string {
 	var urls []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 {
+			urls = append(urls, fields[0])
+		}
+	}
+	return urls
+}
+
+// refreshURL returns the url in the content attribute of a meta refresh tag,
+// such as "5; url=http://example.com/", or an empty string if there is none.
+func refreshURL(content string) string {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return ""
+	}
+	content = strings.TrimSpace(content[i+1:])
+	if len(content) >= 3 && strings.EqualFold(content[:3], "url") {
+		content = strings.TrimSpace(content[3:])
+		if strings.HasPrefix(content, "=") {
+			content = strings.TrimSpace(content[1:])
+		}
+	}
+	return strings.Trim(content, `'"`)
+}
+
+// filterURLs filters through a slice of links, removing any links whose urls
+// can't be parsed or don't have the proper protocols, resolving relative urls
+// against refURL and canonicalizing the resulting urls.
+func filterURLs(links []crawlerdb.Link, refURL string, canon *urlcanon.Canonicalizer) ([]crawlerdb.Link, error) {
+	var filtered []crawlerdb.Link
 	// parse ref url
 	ref, err := url.Parse(refURL)
 	if err != nil {
-		return urls, err
+		return filtered, err
 	}
 
-	for _, path := range links {
+	for _, l := range links {
+		path := l.URL
 		// strip fragments from the url
 		stripFragment, err := url.Parse(path)
 		if err != nil {
@@ -80,7 +482,12 @@ func filterURLs(links []string, refURL string) ([]string, error) {
 		if u.Scheme != "http" && u.Scheme != "https" {
 			continue
 		}
-		urls = append(urls, u.String())
+		l.URL, err = canon.Canonicalize(u.String())
+		if err != nil {
+			fmt.Printf("Unable to canonicalize URL %s: %v", u, err)
+			continue
+		}
+		filtered = append(filtered, l)
 	}
-	return urls, nil
+	return filtered, nil
 }
@@ -2,35 +2,233 @@ package graphcrawler
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"testing"
 
+	"github.com/emilyzhang/crawlr/crawlerdb"
+	"github.com/emilyzhang/crawlr/urlcanon"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestURLParsing(t *testing.T) {
 	t.Run("successfully retrieves http response from url", func(tt *testing.T) {
-		_, err := getRequest("http://google.com")
+		fetcher := FetcherFunc(func(req *http.Request) (*http.Response, error) {
+			assert.Equal(tt, "http://example.com", req.URL.String())
+			assert.Equal(tt, "*/*", req.Header.Get("Accept"))
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString("<html></html>"))}, nil
+		})
+		_, err := getRequest(context.Background(), fetcher, "http://example.com", http.Header{"Accept": []string{"*/*"}})
 		assert.NoError(tt, err)
 	})
 
+	t.Run("successfully returns status errors for error responses", func(tt *testing.T) {
+		fetcher := FetcherFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(bytes.NewBufferString("not found"))}, nil
+		})
+		_, err := getRequest(context.Background(), fetcher, "http://example.com/missing", nil)
+		assert.Equal(tt, &statusError{statusCode: http.StatusNotFound}, err)
+	})
+
 	t.Run("successfully finds all expected raw urls from page", func(tt *testing.T) {
 		resp := &http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(`<body><a href="index.html">origin</a><a href="<http://support.com>">support</a><a href="<http://google.com>">search<a><a href="<https://support.com/example>">support<a></body>`))}
-		urls := findRawURLs(resp)
+		urls := parseHTML(resp.Body).links
 		assert.Len(tt, urls, 4)
 	})
 
 	t.Run("successfully parses raw urls to expected format, stripping fragments", func(tt *testing.T) {
 		resp := &http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(`<body><a href="index.html">origin</a><a href="http://support.com/#hello">support</a><a href="http://google.com">search<a><a href="https://support.com/example">support<a></body>`))}
-		urls := findRawURLs(resp)
-		urls, err := filterURLs(urls, "http://example.com/about")
+		urls := parseHTML(resp.Body).links
+		urls, err := filterURLs(urls, "http://example.com/about", &urlcanon.Canonicalizer{})
 		assert.NoError(tt, err)
 		assert.Len(tt, urls, 4)
 		// parses relative urls correctly
-		assert.Equal(tt, "http://example.com/index.html", urls[0])
+		assert.Equal(tt, "http://example.com/index.html", urls[0].URL)
 		// strips fragment correctly
-		assert.Equal(tt, "http://support.com/", urls[1])
+		assert.Equal(tt, "http://support.com/", urls[1].URL)
+	})
+
+	t.Run("successfully canonicalizes urls", func(tt *testing.T) {
+		resp := &http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(`<body><a href="HTTP://Example.com:80/a/../b?utm_source=x">b</a><a href="/c/./d">d</a></body>`))}
+		urls, err := filterURLs(parseHTML(resp.Body).links, "http://example.com/about", &urlcanon.Canonicalizer{StripParams: urlcanon.DefaultStripParams})
+		assert.NoError(tt, err)
+		assert.Len(tt, urls, 2)
+		assert.Equal(tt, "http://example.com/b", urls[0].URL)
+		assert.Equal(tt, "http://example.com/c/d", urls[1].URL)
+	})
+
+	t.Run("successfully finds links in all link-bearing tags with their edge kinds", func(tt *testing.T) {
+		body := `<html><head>
+			<link rel="stylesheet" href="/style.css"/>
+			<script src="/app.js"></script>
+			<meta http-equiv="Refresh" content="5; URL='/refreshed'">
+		</head><body>
+			<a href="/a">a</a>
+			<img src="/small.png" srcset="/small.png 1x, /large.png 2x">
+			<map><area href="/area"></map>
+			<iframe src="/embedded"></iframe>
+			<form action="/search"></form>
+		</body></html>`
+		links := parseHTML(bytes.NewBufferString(body)).links
+		assert.Equal(tt, []crawlerdb.Link{
+			{URL: "/style.css", Kind: crawlerdb.EdgeKindResource, Rel: "stylesheet"},
+			{URL: "/app.js", Kind: crawlerdb.EdgeKindResource},
+			{URL: "/refreshed", Kind: crawlerdb.EdgeKindRefresh},
+			{URL: "/a", Kind: crawlerdb.EdgeKindNavigation},
+			{URL: "/small.png", Kind: crawlerdb.EdgeKindResource},
+			{URL: "/small.png", Kind: crawlerdb.EdgeKindResource},
+			{URL: "/large.png", Kind: crawlerdb.EdgeKindResource},
+			{URL: "/area", Kind: crawlerdb.EdgeKindNavigation},
+			{URL: "/embedded", Kind: crawlerdb.EdgeKindEmbed},
+			{URL: "/search", Kind: crawlerdb.EdgeKindForm},
+		}, links)
+	})
+
+	t.Run("successfully resolves links against the base url and captures rel values", func(tt *testing.T) {
+		body := `<head><base href="/docs/"></head><body><a href="intro.html" rel="NoFollow  noopener">intro</a><a href="/about">about</a><a href="ad" rel="sponsored">ad</a></body>`
+		doc := parseHTML(bytes.NewBufferString(body))
+		assert.Equal(tt, "http://example.com/docs/", doc.baseURL("http://example.com/a/b"))
+		links, err := filterURLs(doc.links, doc.baseURL("http://example.com/a/b"), &urlcanon.Canonicalizer{})
+		assert.NoError(tt, err)
+		assert.Len(tt, links, 3)
+		assert.Equal(tt, crawlerdb.Link{URL: "http://example.com/docs/intro.html", Kind: crawlerdb.EdgeKindNavigation, Rel: "nofollow noopener"}, links[0])
+		assert.Equal(tt, "http://example.com/about", links[1].URL)
+		assert.True(tt, isNofollow(links[0].Rel))
+		assert.False(tt, isNofollow(links[1].Rel))
+		assert.True(tt, isNofollow(links[2].Rel))
+
+		// followed links depend on the crawl request options
+		cr := &crawlerdb.CrawlRequest{CrawlOptions: crawlerdb.CrawlOptions{FollowKinds: []string{crawlerdb.EdgeKindNavigation}}}
+		assert.Len(tt, followedURLs(links, cr), 3)
+		cr.SkipNofollow = true
+		assert.Equal(tt, []string{"http://example.com/about"}, followedURLs(links, cr))
 	})
 
+	t.Run("successfully finds the canonical url of a page", func(tt *testing.T) {
+		body := `<head><base href="/docs/"><link rel="Canonical" href="Intro.html?utm_source=x#top"><link rel="canonical" href="/other"></head>`
+		doc := parseHTML(bytes.NewBufferString(body))
+		canon := &urlcanon.Canonicalizer{StripParams: urlcanon.DefaultStripParams}
+		assert.Equal(tt, "http://example.com/docs/Intro.html", doc.canonicalURL("http://example.com/a/b", canon))
+		assert.Equal(tt, "", parseHTML(bytes.NewBufferString(`<a href="/a">a</a>`)).canonicalURL("http://example.com/", canon))
+	})
+
+}
+
+func TestRedirects(t *testing.T) {
+	t.Run("successfully detects redirect responses", func(tt *testing.T) {
+		resp := &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{"Location": []string{"/new"}}}
+		assert.True(tt, isRedirect(resp))
+		resp = &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{}}
+		assert.False(tt, isRedirect(resp))
+		resp = &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{"Location": []string{"/new"}}}
+		assert.False(tt, isRedirect(resp))
+	})
+
+	t.Run("successfully resolves redirect locations, stripping fragments", func(tt *testing.T) {
+		resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{"Location": []string{"../new#top"}}}
+		location, err := redirectLocation(resp, "http://example.com/a/b")
+		assert.NoError(tt, err)
+		assert.Equal(tt, "http://example.com/new", location)
+
+		resp.Header.Set("Location", "mailto:someone@example.com")
+		_, err = redirectLocation(resp, "http://example.com/a/b")
+		assert.Error(tt, err)
+	})
+}
+
+func TestContentTypes(t *testing.T) {
+	newResponse := func(contentType, body string) *http.Response {
+		header := http.Header{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		return &http.Response{Header: header, ContentLength: -1, Body: ioutil.NopCloser(bytes.NewBufferString(body))}
+	}
+
+	t.Run("successfully reads html bodies up to the maximum size", func(tt *testing.T) {
+		page := &crawlerdb.Page{}
+		body, err := readHTML(newResponse("text/html; charset=utf-8", `<a href="/a">a</a><a href="/b">b</a>`), page, 18)
+		assert.NoError(tt, err)
+		assert.Equal(tt, "text/html", page.MediaType)
+		assert.Equal(tt, int64(18), page.ContentLength)
+		assert.Equal(tt, []crawlerdb.Link{{URL: "/a", Kind: crawlerdb.EdgeKindNavigation}}, parseHTML(bytes.NewReader(body)).links)
+	})
+
+	t.Run("successfully skips non-html bodies", func(tt *testing.T) {
+		page := &crawlerdb.Page{}
+		resp := newResponse("image/png", "not really a png")
+		resp.ContentLength = 16
+		body, err := readHTML(resp, page, 1024)
+		assert.NoError(tt, err)
+		assert.Nil(tt, body)
+		assert.Equal(tt, "image/png", page.MediaType)
+		assert.Equal(tt, int64(16), page.ContentLength)
+	})
+
+	t.Run("successfully sniffs the media type when it is missing", func(tt *testing.T) {
+		page := &crawlerdb.Page{}
+		body, err := readHTML(newResponse("", `<!DOCTYPE html><a href="/a">a</a>`), page, 1024)
+		assert.NoError(tt, err)
+		assert.NotNil(tt, body)
+		assert.Equal(tt, "text/html", page.MediaType)
+
+		body, err = readHTML(newResponse("", "%PDF-1.4 something"), page, 1024)
+		assert.NoError(tt, err)
+		assert.Nil(tt, body)
+		assert.Equal(tt, "application/pdf", page.MediaType)
+	})
+
+	t.Run("successfully transcodes non-utf-8 bodies", func(tt *testing.T) {
+		page := &crawlerdb.Page{}
+		// "/ニュース" in shift_jis, declared in the Content-Type header
+		body, err := readHTML(newResponse("text/html; charset=Shift_JIS", "<a href=\"/\x83j\x83\x85\x81[\x83X\">n</a>"), page, 1024)
+		assert.NoError(tt, err)
+		assert.Equal(tt, "shift_jis", page.Charset)
+		assert.Equal(tt, "/ニュース", parseHTML(bytes.NewReader(body)).links[0].URL)
+
+		// "/новости" in windows-1251, declared in a meta tag
+		body, err = readHTML(newResponse("text/html", "<meta charset=\"windows-1251\"><a href=\"/\xed\xee\xe2\xee\xf1\xf2\xe8\">n</a>"), page, 1024)
+		assert.NoError(tt, err)
+		assert.Equal(tt, "windows-1251", page.Charset)
+		assert.Equal(tt, "/новости", parseHTML(bytes.NewReader(body)).links[0].URL)
+
+		// undeclared utf-8
+		body, err = readHTML(newResponse("text/html", `<a href="/café">c</a>`), page, 1024)
+		assert.NoError(tt, err)
+		assert.Equal(tt, "utf-8", page.Charset)
+		assert.Equal(tt, "/café", parseHTML(bytes.NewReader(body)).links[0].URL)
+	})
+}
+
+func TestPageMetadata(t *testing.T) {
+	t.Run("successfully extracts the metadata of a page", func(tt *testing.T) {
+		doc := parseHTML(bytes.NewBufferString(`<html lang="en-US"><head>
+			<title> Red
+				Shoes | Example </title>
+			<meta name="Description" content="The  best red shoes.">
+			<meta property="og:title" content="Red Shoes">
+			<meta property="og:image" content="https://example.com/shoes.png">
+			<meta property="og:image" content="https://example.com/other.png">
+			<meta name="twitter:card" content="summary">
+			<meta property="twitter:site" content="@example">
+			</head><body>
+			<h1>Red <em>shoes</em></h1><p>Buy them now.</p><h1>Reviews</h1><h1> </h1>
+			<svg><title>icon</title></svg>
+			</body></html>`))
+		assert.Equal(tt, "Red Shoes | Example", doc.metadata.Title)
+		assert.Equal(tt, "The best red shoes.", doc.metadata.Description)
+		assert.Equal(tt, "en-US", doc.metadata.Lang)
+		assert.Equal(tt, []string{"Red shoes", "Reviews"}, doc.metadata.H1s)
+		assert.Equal(tt, map[string]string{"title": "Red Shoes", "image": "https://example.com/shoes.png"}, doc.metadata.OpenGraph)
+		assert.Equal(tt, map[string]string{"card": "summary", "site": "@example"}, doc.metadata.Twitter)
+	})
+
+	t.Run("successfully leaves metadata a page doesn't have empty", func(tt *testing.T) {
+		doc := parseHTML(bytes.NewBufferString(`<p>Hello</p>`))
+		assert.Empty(tt, doc.metadata.Title)
+		assert.Empty(tt, doc.metadata.Lang)
+		assert.Empty(tt, doc.metadata.H1s)
+		assert.Empty(tt, doc.metadata.OpenGraph)
+	})
 }
@@ -0,0 +1,227 @@
+package graphcrawler
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emilyzhang/crawlr/crawlerdb"
+)
+
+// WorkerStats represents how a single worker of a crawler has spent its time
+// since it started.
+type WorkerStats struct {
+	// ID is the worker's index in the crawler's pool.
+	ID int
+	// Tasks is the number of tasks the worker has run.
+	Tasks int
+	// Busy is the amount of time the worker has spent running tasks, and
+	// Uptime the amount of time since it started.
+	Busy   time.Duration
+	Uptime time.Duration
+}
+
+// Utilization returns the fraction of its uptime the worker has spent running
+// tasks.
+func (s WorkerStats) Utilization() float64 {
+	if s.Uptime <= 0 {
+		return 0
+	}
+	return float64(s.Busy) / float64(s.Uptime)
+}
+
+// workerStats keeps track of the stats of a single worker as it runs.
+type workerStats struct {
+	mu      sync.Mutex
+	id      int
+	started time.Time
+	tasks   int
+	busy    time.Duration
+	// busySince is when the worker started running its current task, and is
+	// zero while it isn't running one.
+	busySince time.Time
+}
+
+func newWorkerStats(id int, now time.Time) *workerStats {
+	return &workerStats{id: id, started: now}
+}
+
+// startTask records that the worker started running a task.
+func (s *workerStats) startTask(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks++
+	s.busySince = now
+}
+
+// finishTask records that the worker finished running its current task.
+func (s *workerStats) finishTask(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy += now.Sub(s.busySince)
+	s.busySince = time.Time{}
+}
+
+// snapshot returns the worker's stats as of now, counting the time spent on
+// the task it is currently running.
+func (s *workerStats) snapshot(now time.Time) WorkerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	busy := s.busy
+	if !s.busySince.IsZero() {
+		busy += now.Sub(s.busySince)
+	}
+	return WorkerStats{
+		ID:     s.id,
+		Tasks:  s.tasks,
+		Busy:   busy,
+		Uptime: now.Sub(s.started),
+	}
+}
+
+// Stats returns the stats of every worker of the crawler.
+func (c *GraphCrawler) Stats() []WorkerStats {
+	now := time.Now()
+	stats := make([]WorkerStats, len(c.workers))
+	for i, w := range c.workers {
+		stats[i] = w.snapshot(now)
+	}
+	return stats
+}
+
+// claimedTask is a task claimed by the crawler that is waiting in the prefetch
+// buffer or being run, along with the function that stops extending its lease.
+type claimedTask struct {
+	task          *crawlerdb.Task
+	stopHeartbeat func()
+	leaseLost     <-chan struct{}
+}
+
+// prefetch claims tasks in batches of ClaimBatchSize and hands them to the
+// workers through the prefetch buffer until the crawler shuts down, so that
+// workers don't each have to go to the database for their next task. It
+// blocks while the buffer is full, and when there are no tasks to claim, it
+// waits before looking again, backing off exponentially up to IdleMaxBackoff
+// while the queue stays empty. The leases of claimed tasks are extended from
+// the moment they are claimed, so they don't expire while waiting in the
+// buffer.
+func (c *GraphCrawler) prefetch() {
+	defer c.wg.Done()
+	defer close(c.queue)
+	backoff := time.Duration(0)
+	for !c.stopping() {
+		tasks, err := c.db.ClaimTasksContext(c.ctx, c.cfg.WorkerID, c.cfg.LeaseDuration, c.cfg.ClaimBatchSize)
+		if err != nil {
+			c.handleError(c.ctx, nil, err)
+		}
+		if len(tasks) == 0 {
+			backoff = idleBackoff(backoff, c.cfg.IdleMinBackoff, c.cfg.IdleMaxBackoff)
+			select {
+			case <-c.stop:
+			case <-time.After(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))):
+			}
+			continue
+		}
+		backoff = 0
+		claimed := make([]claimedTask, len(tasks))
+		for i, t := range tasks {
+			stop, lost := c.heartbeat(t)
+			claimed[i] = claimedTask{task: t, stopHeartbeat: stop, leaseLost: lost}
+		}
+		for i, ct := range claimed {
+			select {
+			case c.queue <- ct:
+			case <-c.stop:
+				// the tasks that didn't make it into the buffer are released
+				// along with the rest when the crawler shuts down
+				for _, ct := range claimed[i:] {
+					ct.stopHeartbeat()
+				}
+				return
+			}
+		}
+	}
+}
+
+// worker runs tasks from the prefetch buffer one after another until the
+// crawler shuts down.
+func (c *GraphCrawler) worker(stats *workerStats) {
+	defer c.wg.Done()
+	for {
+		var ct claimedTask
+		var ok bool
+		select {
+		case <-c.stop:
+			return
+		case ct, ok = <-c.queue:
+			if !ok {
+				return
+			}
+		}
+		if c.stopping() {
+			// leave the task to be released along with the rest of the buffer
+			ct.stopHeartbeat()
+			return
+		}
+		stats.startTask(time.Now())
+		c.run(ct.task, ct.leaseLost)
+		ct.stopHeartbeat()
+		stats.finishTask(time.Now())
+	}
+}
+
+// drainQueue stops extending the leases of the tasks left in the prefetch
+// buffer once the crawler has stopped, so that they can be released.
+func (c *GraphCrawler) drainQueue() {
+	for ct := range c.queue {
+		ct.stopHeartbeat()
+	}
+}
+
+// idleBackoff returns how long the crawler waits before looking for tasks
+// again, given how long it waited last time (0 if it just claimed some). The
+// actual wait is randomized between half and all of it, so that idle crawlers
+// don't all poll the database at the same time.
+func idleBackoff(prev, min, max time.Duration) time.Duration {
+	if prev == 0 {
+		return min
+	}
+	if prev *= 2; prev > max {
+		return max
+	}
+	return prev
+}
+
+// logStats periodically prints the utilization of the crawler's workers over
+// the last interval until the crawler shuts down.
+func (c *GraphCrawler) logStats() {
+	ticker := time.NewTicker(c.cfg.StatsInterval)
+	defer ticker.Stop()
+	prev := c.Stats()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		stats := c.Stats()
+		var busy, uptime time.Duration
+		var tasks int
+		perWorker := make([]string, len(stats))
+		for i, s := range stats {
+			d := WorkerStats{
+				Tasks:  s.Tasks - prev[i].Tasks,
+				Busy:   s.Busy - prev[i].Busy,
+				Uptime: s.Uptime - prev[i].Uptime,
+			}
+			busy, uptime, tasks = busy+d.Busy, uptime+d.Uptime, tasks+d.Tasks
+			perWorker[i] = fmt.Sprintf("%d=%.0f%%", s.ID, 100*d.Utilization())
+		}
+		total := WorkerStats{Busy: busy, Uptime: uptime}
+		fmt.Printf("Workers ran %d tasks in the last %s, %.0f%% utilization (%s)\n",
+			tasks, c.cfg.StatsInterval, 100*total.Utilization(), strings.Join(perWorker, " "))
+		prev = stats
+	}
+}
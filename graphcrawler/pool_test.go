@@ -0,0 +1,35 @@
+package graphcrawler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("successfully tracks how much of its time a worker spends on tasks", func(tt *testing.T) {
+		start := time.Now()
+		s := newWorkerStats(3, start)
+		s.startTask(start.Add(time.Second))
+		s.finishTask(start.Add(3 * time.Second))
+		s.startTask(start.Add(6 * time.Second))
+
+		// the task in progress counts towards the time the worker was busy
+		stats := s.snapshot(start.Add(8 * time.Second))
+		assert.Equal(tt, WorkerStats{ID: 3, Tasks: 2, Busy: 4 * time.Second, Uptime: 8 * time.Second}, stats)
+		assert.Equal(tt, 0.5, stats.Utilization())
+		assert.Equal(tt, 0.0, WorkerStats{}.Utilization())
+	})
+
+	t.Run("successfully backs off exponentially while the queue is empty", func(tt *testing.T) {
+		min, max := 250*time.Millisecond, 2*time.Second
+		var backoffs []time.Duration
+		backoff := time.Duration(0)
+		for i := 0; i < 6; i++ {
+			backoff = idleBackoff(backoff, min, max)
+			backoffs = append(backoffs, backoff)
+		}
+		assert.Equal(tt, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second}, backoffs)
+	})
+}
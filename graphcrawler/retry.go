@@ -0,0 +1,80 @@
+package graphcrawler
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// DefaultRetryErrorClasses are the classes of request errors (as reported in
+// the fetch log) retried by default: timeouts, and connections that couldn't
+// be made or broke before the response was complete.
+var DefaultRetryErrorClasses = []string{"timeout", "connect", "reset"}
+
+// DefaultRetryStatusCodes are the status codes retried by default: responses
+// telling the crawler to slow down or that the server is temporarily unable to
+// respond.
+var DefaultRetryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy represents how tasks that fail with a transient error are
+// retried. Zero values are replaced with sensible defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a task is attempted before
+	// it is marked as FAILED. Set it to 1 to never retry tasks.
+	MaxAttempts int
+	// BaseDelay is the delay before a task is retried for the first time. It
+	// doubles with every attempt after that.
+	BaseDelay time.Duration
+	// MaxDelay is the maximum delay before a task is retried.
+	MaxDelay time.Duration
+	// ErrorClasses are the classes of request errors that are retried, using
+	// the same classes as the fetch log ("dns", "connect", "tls", "timeout",
+	// "reset" or "other").
+	ErrorClasses []string
+	// StatusCodes are the response status codes that are retried.
+	StatusCodes []int
+}
+
+// retryable reports whether a task that failed with err may succeed if it is
+// tried again.
+func (p RetryPolicy) retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		for _, code := range p.StatusCodes {
+			if se.statusCode == code {
+				return true
+			}
+		}
+		return false
+	}
+	class := errorClass(err)
+	for _, c := range p.ErrorClasses {
+		if class == c {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before trying a task again after its
+// attempt'th attempt failed. The delay grows exponentially with every attempt,
+// and is randomized between half and all of it, so that tasks that failed at
+// the same time don't all hit the host again at the same time.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,44 @@
+package graphcrawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:  5,
+		BaseDelay:    time.Second,
+		MaxDelay:     10 * time.Second,
+		ErrorClasses: DefaultRetryErrorClasses,
+		StatusCodes:  DefaultRetryStatusCodes,
+	}
+
+	t.Run("successfully retries transient errors only", func(tt *testing.T) {
+		timeout := &url.Error{Op: "Get", URL: "http://example.com/", Err: &net.OpError{Op: "read", Err: timeoutError{}}}
+		dns := &url.Error{Op: "Get", URL: "http://example.com/", Err: &net.DNSError{Err: "no such host", Name: "example.com"}}
+		assert.True(tt, policy.retryable(timeout))
+		assert.True(tt, policy.retryable(fmt.Errorf("Task took longer than 10m0s: %w", context.DeadlineExceeded)))
+		assert.True(tt, policy.retryable(&statusError{statusCode: http.StatusServiceUnavailable}))
+		assert.False(tt, policy.retryable(&statusError{statusCode: http.StatusNotFound}))
+		assert.False(tt, policy.retryable(dns))
+		assert.False(tt, policy.retryable(errors.New("Unable to update page")))
+	})
+
+	t.Run("successfully backs off exponentially with jitter up to the maximum delay", func(tt *testing.T) {
+		for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+			for i := 0; i < 20; i++ {
+				d := policy.backoff(attempt + 1)
+				assert.True(tt, d >= max/2 && d <= max, "attempt %d: %s not between %s and %s", attempt+1, d, max/2, max)
+			}
+		}
+	})
+}
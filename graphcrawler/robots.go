@@ -0,0 +1,418 @@
+package graphcrawler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// robotsUserAgent is the product token the crawler identifies itself with
+	// when matching robots.txt user-agent groups.
+	robotsUserAgent = "crawlr"
+	// robotsCacheTTL is how long a fetched robots.txt is trusted before it is
+	// fetched again.
+	robotsCacheTTL = 24 * time.Hour
+	// robotsErrorTTL is how long a failure to fetch a robots.txt is
+	// remembered, which is shorter since the failure may be temporary. Tasks
+	// for the host fail with the same error in the meantime, and are retried
+	// under the retry policy if it is transient.
+	robotsErrorTTL = time.Minute
+	// robotsMaxSize is the maximum number of bytes of a robots.txt file that
+	// will be parsed, anything past that is ignored.
+	robotsMaxSize = 500 * 1024
+	// robotsMaxRedirects is the maximum number of redirects followed when
+	// fetching a robots.txt file.
+	robotsMaxRedirects = 5
+)
+
+// errBlockedByRobots is returned when a url is disallowed by its host's
+// robots.txt.
+var errBlockedByRobots = errors.New("url is disallowed by robots.txt")
+
+// robotsRule represents a single Allow or Disallow line in a robots.txt group.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsGroup represents a set of rules that apply to one or more user-agents.
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// robots represents a parsed robots.txt file.
+type robots struct {
+	groups   []*robotsGroup
+	sitemaps []string
+}
+
+// parseRobots parses the contents of a robots.txt file. Unknown lines and
+// lines that appear outside of a group are ignored.
+func parseRobots(r io.Reader) *robots {
+	rb := &robots{}
+	var current *robotsGroup
+	// lastWasAgent tracks whether the previous line was a user-agent line, so
+	// consecutive user-agent lines are collected into the same group.
+	lastWasAgent := false
+	scanner := bufio.NewScanner(io.LimitReader(r, robotsMaxSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			if !lastWasAgent || current == nil {
+				current = &robotsGroup{}
+				rb.groups = append(rb.groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			lastWasAgent = true
+			continue
+		case "allow", "disallow":
+			// an empty disallow means everything is allowed, so there's no
+			// need to record it as a rule
+			if current != nil && value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			if current != nil {
+				if d, err := strconv.ParseFloat(value, 64); err == nil && d >= 0 {
+					current.crawlDelay = time.Duration(d * float64(time.Second))
+				}
+			}
+		case "sitemap":
+			// sitemap lines are not tied to any group
+			if value != "" {
+				rb.sitemaps = append(rb.sitemaps, value)
+			}
+		}
+		lastWasAgent = false
+	}
+	return rb
+}
+
+// group returns the group of rules that applies to the given product token.
+// As described in RFC 9309, that's the group with a user-agent equal to the
+// token, ignoring case, falling back to the "*" group, and the rules of several
+// such groups are combined. It returns nil if no group applies.
+func (rb *robots) group(userAgent string) *robotsGroup {
+	userAgent = strings.ToLower(userAgent)
+	var matched, wildcards []*robotsGroup
+	for _, g := range rb.groups {
+		if g.matches(userAgent) {
+			matched = append(matched, g)
+		} else if g.matches("*") {
+			wildcards = append(wildcards, g)
+		}
+	}
+	if len(matched) == 0 {
+		matched = wildcards
+	}
+	switch len(matched) {
+	case 0:
+		return nil
+	case 1:
+		return matched[0]
+	}
+	combined := &robotsGroup{}
+	for _, g := range matched {
+		combined.agents = append(combined.agents, g.agents...)
+		combined.rules = append(combined.rules, g.rules...)
+		if combined.crawlDelay == 0 {
+			combined.crawlDelay = g.crawlDelay
+		}
+	}
+	return combined
+}
+
+// matches reports whether one of the group's user-agents is the given
+// lowercased one.
+func (g *robotsGroup) matches(userAgent string) bool {
+	for _, a := range g.agents {
+		if a == userAgent {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the given user-agent may crawl the given url. The
+// longest matching rule wins, and Allow wins when an Allow and a Disallow rule
+// match with the same length.
+func (rb *robots) allowed(userAgent string, u *url.URL) bool {
+	// robots.txt itself is always allowed
+	if u.Path == "/robots.txt" {
+		return true
+	}
+	g := rb.group(userAgent)
+	if g == nil {
+		return true
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	allow, matchLen := true, -1
+	for _, r := range g.rules {
+		if !robotsMatch(r.pattern, path) {
+			continue
+		}
+		if l := len(r.pattern); l > matchLen || (l == matchLen && r.allow) {
+			allow, matchLen = r.allow, l
+		}
+	}
+	return allow
+}
+
+// crawlDelay returns the Crawl-delay that applies to the given user-agent, or
+// zero if there is none.
+func (rb *robots) crawlDelay(userAgent string) time.Duration {
+	if g := rb.group(userAgent); g != nil {
+		return g.crawlDelay
+	}
+	return 0
+}
+
+// robotsMatch reports whether a robots.txt path pattern matches the given
+// path. Patterns may contain "*" to match any sequence of characters and may
+// end in "$" to anchor the match to the end of the path.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+	parts := strings.Split(pattern, "*")
+	// the first part must be a prefix of the path
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+	for i := 1; i < len(parts); i++ {
+		part := parts[i]
+		if i == len(parts)-1 && anchored {
+			// the last part must match the end of the path
+			return strings.HasSuffix(path[pos:], part)
+		}
+		j := strings.Index(path[pos:], part)
+		if j < 0 {
+			return false
+		}
+		pos += j + len(part)
+	}
+	return !anchored || pos == len(path)
+}
+
+// robotsEntry represents a cached robots.txt file for a single host, or the
+// error fetching it.
+type robotsEntry struct {
+	robots    *robots
+	err       error
+	fetchedAt time.Time
+}
+
+// expired reports whether the entry should be fetched again.
+func (e *robotsEntry) expired() bool {
+	ttl := robotsCacheTTL
+	if e.err != nil {
+		ttl = robotsErrorTTL
+	}
+	return time.Since(e.fetchedAt) >= ttl
+}
+
+// robotsCache fetches and caches robots.txt files per host. It is safe for
+// concurrent use by multiple workers, and only fetches a host's robots.txt
+// once when several workers need it at the same time.
+type robotsCache struct {
+	mu      sync.Mutex
+	entries map[string]*robotsEntry
+	// fetching holds a channel for every host whose robots.txt is being
+	// fetched, which is closed once the fetch is done.
+	fetching map[string]chan struct{}
+	fetcher  Fetcher
+	// acquire is called before every request, see hostLimiter.
+	acquire hostLimiter
+}
+
+// hostLimiter waits until a request may be made to the given host under the
+// given context, and returns a function that must be called once the request
+// is done.
+type hostLimiter func(ctx context.Context, host string) (release func(), err error)
+
+// newRobotsCache creates a new, empty robotsCache, which fetches robots.txt
+// files using the given fetcher. If acquire isn't nil, every request waits for
+// it first.
+func newRobotsCache(fetcher Fetcher, acquire hostLimiter) *robotsCache {
+	return &robotsCache{
+		entries:  make(map[string]*robotsEntry),
+		fetching: make(map[string]chan struct{}),
+		fetcher:  fetcher,
+		acquire:  acquire,
+	}
+}
+
+// get returns the robots.txt rules for the host of the given url, fetching
+// them under the given context if they're not cached or the cached copy has
+// expired. If the robots.txt couldn't be fetched, it returns the error instead,
+// and nothing on the host may be crawled until it can be.
+func (rc *robotsCache) get(ctx context.Context, u *url.URL) (*robots, error) {
+	key := u.Scheme + "://" + u.Host
+	for {
+		rc.mu.Lock()
+		if e, ok := rc.entries[key]; ok && !e.expired() {
+			rc.mu.Unlock()
+			return e.robots, e.err
+		}
+		if done, ok := rc.fetching[key]; ok {
+			// wait for the other worker's fetch, and look again
+			rc.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-done:
+			}
+			continue
+		}
+		done := make(chan struct{})
+		rc.fetching[key] = done
+		rc.mu.Unlock()
+
+		rb, err := rc.fetch(ctx, key+"/robots.txt")
+		rc.mu.Lock()
+		delete(rc.fetching, key)
+		// a fetch cut short by the task's context says nothing about the host
+		if ctx.Err() == nil {
+			rc.entries[key] = &robotsEntry{robots: rb, err: err, fetchedAt: time.Now()}
+		}
+		rc.mu.Unlock()
+		close(done)
+		return rb, err
+	}
+}
+
+// fetch retrieves and parses a robots.txt file, following up to
+// robotsMaxRedirects redirects. A missing robots.txt (any 4xx status code)
+// allows everything, while a server error or network failure is returned as an
+// error, since the host may not want to be crawled at all.
+func (rc *robotsCache) fetch(ctx context.Context, robotsURL string) (*robots, error) {
+	resp, err := rc.request(ctx, robotsURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch %s: %w", robotsURL, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return parseRobots(resp.Body), nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, robotsMaxSize))
+		return &robots{}, nil
+	default:
+		return nil, fmt.Errorf("Unable to fetch %s: %w", robotsURL, &statusError{statusCode: resp.StatusCode})
+	}
+}
+
+// request makes a GET request for a robots.txt file under the given context,
+// following redirects. Every request holds a slot from the host limiter until
+// its response body is closed.
+func (rc *robotsCache) request(ctx context.Context, robotsURL string) (*http.Response, error) {
+	// robots.txt files are shared between crawl requests, so they aren't
+	// recorded as made for the crawl request whose task fetched them
+	ctx = withCrawlRequest(ctx, 0)
+	for redirects := 0; ; redirects++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := rc.do(req)
+		if err != nil || !isRedirect(resp) {
+			return resp, err
+		}
+		resp.Body.Close()
+		if redirects == robotsMaxRedirects {
+			return nil, fmt.Errorf("Stopped after %d redirects", robotsMaxRedirects)
+		}
+		robotsURL, err = redirectLocation(resp, robotsURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// do sends a single request once the host limiter allows it.
+func (rc *robotsCache) do(req *http.Request) (*http.Response, error) {
+	if rc.acquire == nil {
+		return rc.fetcher.Do(req)
+	}
+	release, err := rc.acquire(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rc.fetcher.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// robotsDirectiveNames are the directives of a robots meta tag or X-Robots-Tag
+// header that take a value after a colon, which mustn't be mistaken for a
+// user-agent prefix.
+var robotsDirectiveNames = map[string]bool{
+	"unavailable_after": true,
+	"max-snippet":       true,
+	"max-image-preview": true,
+	"max-video-preview": true,
+}
+
+// parseRobotsDirectives parses the comma separated directives of a robots meta
+// tag or an X-Robots-Tag header, such as "noindex, nofollow", and reports
+// whether they include noindex or nofollow. X-Robots-Tag values may start with
+// a user-agent, such as "otherbot: noindex", in which case they're ignored
+// unless the user-agent is the crawler's.
+func parseRobotsDirectives(value string) (noindex, nofollow bool) {
+	if i := strings.Index(value, ":"); i >= 0 {
+		agent := strings.ToLower(strings.TrimSpace(value[:i]))
+		if !robotsDirectiveNames[agent] && !strings.Contains(agent, ",") {
+			if agent != robotsUserAgent {
+				return false, false
+			}
+			value = value[i+1:]
+		}
+	}
+	for _, d := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(d)) {
+		case "noindex":
+			noindex = true
+		case "nofollow":
+			nofollow = true
+		case "none":
+			noindex, nofollow = true, true
+		}
+	}
+	return noindex, nofollow
+}
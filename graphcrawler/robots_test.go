@@ -0,0 +1,201 @@
+package graphcrawler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRobots(t *testing.T) {
+	robotsTxt := `
+# example robots.txt
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+
+User-agent: crawlr
+User-agent: otherbot
+Disallow: /no-crawlr
+Allow: /no-crawlr/except
+Crawl-delay: 2.5
+
+Sitemap: http://example.com/sitemap.xml
+`
+	rb := parseRobots(strings.NewReader(robotsTxt))
+	allowed := func(ua, rawURL string) bool {
+		u, err := url.Parse(rawURL)
+		assert.NoError(t, err)
+		return rb.allowed(ua, u)
+	}
+
+	t.Run("successfully parses groups, crawl delays and sitemaps", func(tt *testing.T) {
+		assert.Len(tt, rb.groups, 2)
+		assert.Equal(tt, []string{"crawlr", "otherbot"}, rb.groups[1].agents)
+		assert.Equal(tt, 2500*time.Millisecond, rb.crawlDelay("crawlr"))
+		assert.Equal(tt, time.Duration(0), rb.crawlDelay("somebot"))
+		assert.Equal(tt, []string{"http://example.com/sitemap.xml"}, rb.sitemaps)
+	})
+
+	t.Run("successfully applies the most specific user-agent group", func(tt *testing.T) {
+		// the crawlr group replaces the * group entirely
+		assert.True(tt, allowed("crawlr", "http://example.com/private"))
+		assert.False(tt, allowed("crawlr", "http://example.com/no-crawlr/page"))
+		assert.False(tt, allowed("somebot", "http://example.com/private"))
+		assert.True(tt, allowed("somebot", "http://example.com/no-crawlr/page"))
+	})
+
+	t.Run("successfully matches user-agents exactly and combines their groups", func(tt *testing.T) {
+		rb := parseRobots(strings.NewReader(`
+User-agent: crawl
+User-agent: crawlr-images
+Disallow: /
+
+User-agent: CRAWLR
+Disallow: /a
+Crawl-delay: 1
+
+User-agent: *
+Disallow: /c
+
+User-agent: crawlr
+Disallow: /b
+Crawl-delay: 5
+`))
+		allowed := func(rawURL string) bool {
+			u, _ := url.Parse(rawURL)
+			return rb.allowed("crawlr", u)
+		}
+		assert.False(tt, allowed("http://example.com/a"))
+		assert.False(tt, allowed("http://example.com/b"))
+		assert.True(tt, allowed("http://example.com/c"))
+		assert.True(tt, allowed("http://example.com/d"))
+		assert.Equal(tt, time.Second, rb.crawlDelay("crawlr"))
+	})
+
+	t.Run("successfully prefers the longest match and allow on ties", func(tt *testing.T) {
+		assert.True(tt, allowed("somebot", "http://example.com/private/public/page"))
+		assert.True(tt, allowed("crawlr", "http://example.com/no-crawlr/except"))
+	})
+
+	t.Run("successfully matches wildcards and end anchors", func(tt *testing.T) {
+		assert.False(tt, allowed("somebot", "http://example.com/docs/file.pdf"))
+		assert.True(tt, allowed("somebot", "http://example.com/docs/file.pdf?download=1"))
+		assert.True(tt, robotsMatch("/a*/c", "/abc/cd"))
+		assert.False(tt, robotsMatch("/a*/c$", "/abc/cd"))
+		assert.True(tt, robotsMatch("/a$", "/a"))
+		assert.False(tt, robotsMatch("/a$", "/ab"))
+	})
+
+	t.Run("successfully returns a retryable error when robots.txt is unavailable", func(tt *testing.T) {
+		var fetches int32
+		rc := newRobotsCache(FetcherFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&fetches, 1)
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}), nil)
+		u, _ := url.Parse("http://example.com/page")
+		_, err := rc.get(context.Background(), u)
+		assert.Error(tt, err)
+		assert.True(tt, RetryPolicy{StatusCodes: DefaultRetryStatusCodes}.retryable(err))
+
+		// the failure is remembered for a while
+		_, err = rc.get(context.Background(), u)
+		assert.Error(tt, err)
+		assert.Equal(tt, int32(1), atomic.LoadInt32(&fetches))
+	})
+
+	t.Run("successfully allows everything when robots.txt is missing", func(tt *testing.T) {
+		rc := newRobotsCache(FetcherFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}), nil)
+		u, _ := url.Parse("http://example.com/page")
+		rb, err := rc.get(context.Background(), u)
+		assert.NoError(tt, err)
+		assert.True(tt, rb.allowed("crawlr", u))
+	})
+
+	t.Run("successfully fetches robots.txt once for concurrent misses", func(tt *testing.T) {
+		var fetches int32
+		release := make(chan struct{})
+		rc := newRobotsCache(FetcherFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&fetches, 1)
+			<-release
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("User-agent: *\nDisallow: /private"))}, nil
+		}), nil)
+		u, _ := url.Parse("http://example.com/private/page")
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rb, err := rc.get(context.Background(), u)
+				assert.NoError(tt, err)
+				assert.False(tt, rb.allowed("crawlr", u))
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.Equal(tt, int32(1), atomic.LoadInt32(&fetches))
+	})
+
+	t.Run("successfully holds a host slot while fetching robots.txt", func(tt *testing.T) {
+		var held []string
+		released := 0
+		rc := newRobotsCache(FetcherFunc(func(req *http.Request) (*http.Response, error) {
+			assert.Equal(tt, 1, len(held)-released)
+			if req.URL.Host == "example.com" {
+				return &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{"Location": []string{"http://www.example.com/robots.txt"}}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("User-agent: *\nDisallow: /private"))}, nil
+		}), func(ctx context.Context, host string) (func(), error) {
+			held = append(held, host)
+			return func() { released++ }, nil
+		})
+		u, _ := url.Parse("http://example.com/private/page")
+		rb, err := rc.get(context.Background(), u)
+		assert.NoError(tt, err)
+		assert.False(tt, rb.allowed("crawlr", u))
+		assert.Equal(tt, []string{"example.com", "www.example.com"}, held)
+		assert.Equal(tt, 2, released)
+	})
+}
+
+func TestRobotsDirectives(t *testing.T) {
+	t.Run("successfully parses robots meta tag and X-Robots-Tag directives", func(tt *testing.T) {
+		noindex, nofollow := parseRobotsDirectives("noindex, nofollow")
+		assert.True(tt, noindex)
+		assert.True(tt, nofollow)
+		noindex, nofollow = parseRobotsDirectives("NOINDEX")
+		assert.True(tt, noindex)
+		assert.False(tt, nofollow)
+		noindex, nofollow = parseRobotsDirectives("none")
+		assert.True(tt, noindex)
+		assert.True(tt, nofollow)
+		noindex, nofollow = parseRobotsDirectives("unavailable_after: 25 Jun 2010 15:00:00 PST, nofollow")
+		assert.False(tt, noindex)
+		assert.True(tt, nofollow)
+	})
+
+	t.Run("successfully ignores directives for other user-agents", func(tt *testing.T) {
+		noindex, nofollow := parseRobotsDirectives("otherbot: noindex, nofollow")
+		assert.False(tt, noindex)
+		assert.False(tt, nofollow)
+		noindex, _ = parseRobotsDirectives("crawlr: noindex")
+		assert.True(tt, noindex)
+	})
+
+	t.Run("successfully finds robots meta tags in html", func(tt *testing.T) {
+		doc := parseHTML(strings.NewReader(`<head><meta name="Robots" content="nofollow"><meta name="otherbot" content="noindex"></head>`))
+		assert.False(tt, doc.noindex)
+		assert.True(tt, doc.nofollow)
+	})
+}
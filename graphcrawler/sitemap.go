@@ -0,0 +1,220 @@
+package graphcrawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emilyzhang/crawlr/crawlerdb"
+)
+
+const (
+	// sitemapMaxSize is the maximum number of (uncompressed) bytes of a
+	// sitemap that will be parsed, which is the limit set by the sitemaps
+	// protocol.
+	sitemapMaxSize = 50 << 20
+	// sitemapMaxFiles is the maximum number of sitemap files, including
+	// sitemap indexes, fetched for a single crawl request.
+	sitemapMaxFiles = 100
+)
+
+// gzipMagic are the first bytes of a gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// sitemap represents a parsed sitemap file, which is either a sitemap index
+// listing other sitemaps, or a list of page urls.
+type sitemap struct {
+	sitemaps []string
+	urls     []string
+}
+
+// parseSitemap parses a sitemap index, an xml urlset or a plain text sitemap
+// with one url per line. Gzipped sitemaps are decompressed first.
+func parseSitemap(r io.Reader) (*sitemap, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decompress sitemap: %v", err)
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	lr := bufio.NewReader(io.LimitReader(br, sitemapMaxSize))
+
+	// xml sitemaps start with a tag (possibly after some whitespace or a byte
+	// order mark), anything else is treated as a text sitemap
+	for {
+		b, err := lr.Peek(1)
+		if err != nil {
+			return &sitemap{}, nil
+		}
+		if b[0] == '<' {
+			return parseXMLSitemap(lr)
+		} else if strings.IndexByte(" \t\r\n\xef\xbb\xbf", b[0]) < 0 {
+			return parseTextSitemap(lr)
+		}
+		lr.ReadByte()
+	}
+}
+
+// parseXMLSitemap collects the <loc> of every <sitemap> in a sitemap index,
+// and of every <url> in a urlset.
+func parseXMLSitemap(r io.Reader) (*sitemap, error) {
+	sm := &sitemap{}
+	decoder := xml.NewDecoder(r)
+	// sitemaps are supposed to be utf-8, but don't fail on ones that claim
+	// otherwise
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var parents []string
+	var loc strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return sm, nil
+		} else if err != nil {
+			return sm, fmt.Errorf("Unable to parse sitemap: %v", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			parents = append(parents, t.Name.Local)
+			loc.Reset()
+		case xml.CharData:
+			loc.Write(t)
+		case xml.EndElement:
+			parents = parents[:len(parents)-1]
+			if t.Name.Local != "loc" || len(parents) == 0 {
+				continue
+			}
+			switch parents[len(parents)-1] {
+			case "sitemap":
+				sm.sitemaps = append(sm.sitemaps, strings.TrimSpace(loc.String()))
+			case "url":
+				sm.urls = append(sm.urls, strings.TrimSpace(loc.String()))
+			}
+		}
+	}
+}
+
+// parseTextSitemap collects the urls of a text sitemap, one per line.
+func parseTextSitemap(r io.Reader) (*sitemap, error) {
+	sm := &sitemap{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			sm.urls = append(sm.urls, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sm, fmt.Errorf("Unable to parse sitemap: %v", err)
+	}
+	return sm, nil
+}
+
+// sitemapLinks discovers the sitemaps of the host of the given page, both from
+// its robots.txt and at /sitemap.xml, and returns links to every page listed in
+// them, following sitemap indexes. At most maxURLs links are returned.
+func (c *GraphCrawler) sitemapLinks(ctx context.Context, crawlRequestID int, page *crawlerdb.Page, maxURLs int) ([]crawlerdb.Link, error) {
+	var links []crawlerdb.Link
+	u, err := url.Parse(page.URL)
+	if err != nil {
+		return links, err
+	}
+	root := u.Scheme + "://" + u.Host
+	rb, err := c.robots.get(ctx, u)
+	if err != nil {
+		return links, err
+	}
+	queue := append([]string{}, rb.sitemaps...)
+	queue = append(queue, root+"/sitemap.xml")
+
+	seenSitemaps := make(map[string]bool)
+	seenURLs := make(map[string]bool)
+	for fetched := 0; len(queue) > 0 && fetched < sitemapMaxFiles && len(links) < maxURLs; {
+		sitemapURL := queue[0]
+		queue = queue[1:]
+		if seenSitemaps[sitemapURL] {
+			continue
+		}
+		seenSitemaps[sitemapURL] = true
+		fetched++
+
+		sm, err := c.fetchSitemap(ctx, crawlRequestID, sitemapURL)
+		if err != nil {
+			// a missing sitemap is expected, so just move on to the next one,
+			// keeping whatever could be parsed before the error
+			fmt.Printf("Unable to fetch sitemap %s: %v\n", sitemapURL, err)
+			if sm == nil {
+				continue
+			}
+		}
+		for _, s := range sm.sitemaps {
+			if ref, err := url.Parse(sitemapURL); err == nil {
+				if su, err := ref.Parse(s); err == nil {
+					queue = append(queue, su.String())
+				}
+			}
+		}
+		found := make([]crawlerdb.Link, 0, len(sm.urls))
+		for _, v := range sm.urls {
+			found = append(found, crawlerdb.Link{URL: v, Kind: crawlerdb.EdgeKindSitemap})
+		}
+		found, err = filterURLs(found, sitemapURL, c.cfg.Canonicalizer)
+		if err != nil {
+			continue
+		}
+		for _, l := range found {
+			if len(links) >= maxURLs {
+				break
+			}
+			if !seenURLs[l.URL] {
+				seenURLs[l.URL] = true
+				links = append(links, l)
+			}
+		}
+	}
+	return links, nil
+}
+
+// fetchSitemap fetches and parses a single sitemap, following redirects. If
+// the host has no request budget available, it waits until it does, since
+// the crawl request's sitemaps are fetched all at once, unless ctx is done
+// first.
+func (c *GraphCrawler) fetchSitemap(ctx context.Context, crawlRequestID int, sitemapURL string) (*sitemap, error) {
+	for redirects := 0; ; {
+		resp, err := c.fetch(withCrawlRequest(ctx, crawlRequestID), sitemapURL, nil)
+		if de, ok := err.(*deferError); ok {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Until(de.until)):
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if isRedirect(resp) {
+			resp.Body.Close()
+			redirects++
+			if redirects > c.cfg.MaxRedirects {
+				return nil, fmt.Errorf("Stopped after %d redirects", c.cfg.MaxRedirects)
+			}
+			sitemapURL, err = redirectLocation(resp, sitemapURL)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		return parseSitemap(resp.Body)
+	}
+}
@@ -0,0 +1,41 @@
+package graphcrawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSitemaps(t *testing.T) {
+	t.Run("successfully parses urlsets", func(tt *testing.T) {
+		body := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc> http://example.com/a </loc><lastmod>2020-01-01</lastmod></url>
+  <url><loc>http://example.com/b?x=1&amp;y=2</loc></url>
+</urlset>`
+		sm, err := parseSitemap(strings.NewReader(body))
+		assert.NoError(tt, err)
+		assert.Equal(tt, []string{"http://example.com/a", "http://example.com/b?x=1&y=2"}, sm.urls)
+		assert.Empty(tt, sm.sitemaps)
+	})
+
+	t.Run("successfully parses gzipped sitemap indexes", func(tt *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(`<sitemapindex><sitemap><loc>http://example.com/sitemap1.xml.gz</loc></sitemap><sitemap><loc>/sitemap2.xml</loc></sitemap></sitemapindex>`))
+		zw.Close()
+		sm, err := parseSitemap(&buf)
+		assert.NoError(tt, err)
+		assert.Equal(tt, []string{"http://example.com/sitemap1.xml.gz", "/sitemap2.xml"}, sm.sitemaps)
+		assert.Empty(tt, sm.urls)
+	})
+
+	t.Run("successfully parses text sitemaps", func(tt *testing.T) {
+		sm, err := parseSitemap(strings.NewReader("\n http://example.com/a\n\nhttp://example.com/b\n"))
+		assert.NoError(tt, err)
+		assert.Equal(tt, []string{"http://example.com/a", "http://example.com/b"}, sm.urls)
+	})
+}
@@ -0,0 +1,52 @@
+package graphcrawler
+
+import (
+	"context"
+	"time"
+
+	"github.com/emilyzhang/crawlr/crawlerdb"
+)
+
+// store is the part of the database the crawler works with. It is implemented
+// by *crawlerdb.Postgres, and can be replaced with an in-memory fake in tests.
+type store interface {
+	// crawl requests and tasks
+	GetCrawlRequestContext(ctx context.Context, id int) (*crawlerdb.CrawlRequest, error)
+	GetCrawlRequestTasksContext(ctx context.Context, crawlRequestID int) ([]*crawlerdb.Task, error)
+	CreateTasksContext(ctx context.Context, tasks []*crawlerdb.Task) error
+	ClaimTasksContext(ctx context.Context, workerID string, lease time.Duration, n int) ([]*crawlerdb.Task, error)
+	ExtendTaskLease(id int, workerID string, lease time.Duration) error
+	UpdateTaskStatusContext(ctx context.Context, id int, workerID string, status string) error
+	UpdateTaskFinalURLContext(ctx context.Context, id int, workerID string, url string) error
+	LinksAddedForURLContext(ctx context.Context, crawlRequestID, taskID int, url string) (bool, error)
+	DeferTaskContext(ctx context.Context, id int, workerID string, until time.Time) error
+	RetryTask(id int, workerID string, lastError string, until time.Time) error
+	FailTask(id int, workerID string, lastError string) error
+	ReleaseTasks(workerID string) (int, error)
+	RecoverExpiredTasks(maxAttempts int) (int, error)
+
+	// pages and edges
+	UpsertPageContext(ctx context.Context, url string) (int, error)
+	GetPageContext(ctx context.Context, id int) (*crawlerdb.Page, error)
+	UpdatePageFetchContext(ctx context.Context, page *crawlerdb.Page) error
+	UpdatePageStatusContext(ctx context.Context, pageID int, statusCode int) error
+	UpdatePageMetadataContext(ctx context.Context, pageID int, m *crawlerdb.PageMetadata) error
+	UpdatePageContentContext(ctx context.Context, pageID int, text string, m *crawlerdb.PageMetadata) error
+	GetEdgesForPageContext(ctx context.Context, page *crawlerdb.Page) ([]crawlerdb.Edge, error)
+	UpdatePageEdgesContext(ctx context.Context, pageID int, links []crawlerdb.Link) error
+	UpdateSitemapEdgesContext(ctx context.Context, pageID int, links []crawlerdb.Link) error
+	AddRedirectEdgeContext(ctx context.Context, pageID int, url string, statusCode int) (int, error)
+	FindDuplicatePageContext(ctx context.Context, page *crawlerdb.Page) (int, error)
+	MergeAliasContext(ctx context.Context, aliasID, canonicalID int) error
+	UnmergeAliasContext(ctx context.Context, aliasID int) error
+
+	// fetches and archives
+	AddPageFetch(f *crawlerdb.PageFetch) error
+	AddWARCRecords(records []*crawlerdb.WARCRecord) error
+
+	// hosts
+	AcquireHostSlotContext(ctx context.Context, host string, maxConns int, delay, ttl time.Duration) (int, time.Time, error)
+	ReleaseHostSlot(id int) error
+
+	Close() error
+}
@@ -1,27 +1,134 @@
 CREATE TABLE page_nodes (
     id             SERIAL PRIMARY KEY,
     url            TEXT NOT NULL UNIQUE,
-    crawled_status BOOLEAN NOT NULL
+    crawled_status BOOLEAN NOT NULL,
+    fetched_at     TIMESTAMPTZ,
+    etag           TEXT,
+    last_modified  TEXT,
+    media_type     TEXT,
+    charset        TEXT,
+    content_length BIGINT,
+    noindex        BOOLEAN NOT NULL DEFAULT false,
+    status_code    INTEGER,
+    canonical_url  TEXT,
+    alias_of       INTEGER REFERENCES page_nodes(id),
+    content_hash   TEXT,
+    simhash        BIGINT,
+    duplicate_of   INTEGER REFERENCES page_nodes(id)
 );
 
+CREATE INDEX page_nodes_content_hash_idx ON page_nodes (content_hash);
+
+CREATE TABLE page_metadata (
+    page_id     INTEGER PRIMARY KEY REFERENCES page_nodes(id),
+    title       TEXT,
+    description TEXT,
+    lang        TEXT,
+    h1s         JSONB NOT NULL DEFAULT '[]',
+    word_count  INTEGER NOT NULL DEFAULT 0,
+    open_graph  JSONB NOT NULL DEFAULT '{}',
+    twitter     JSONB NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE page_contents (
+    page_id       INTEGER PRIMARY KEY REFERENCES page_nodes(id),
+    content_text  TEXT NOT NULL,
+    search_vector TSVECTOR NOT NULL
+);
+
+CREATE INDEX page_contents_search_vector_idx ON page_contents USING GIN (search_vector);
+
 CREATE TABLE crawl_requests (
     id SERIAL PRIMARY KEY,
     url TEXT NOT NULL,
-    levels INTEGER NOT NULL
+    levels INTEGER NOT NULL,
+    max_age INTEGER NOT NULL DEFAULT 0,
+    follow_kinds TEXT NOT NULL DEFAULT 'navigation',
+    skip_nofollow BOOLEAN NOT NULL DEFAULT false,
+    collapse_duplicates BOOLEAN NOT NULL DEFAULT false,
+    use_sitemaps BOOLEAN NOT NULL DEFAULT false,
+    reuse_duplicates BOOLEAN NOT NULL DEFAULT false,
+    archive_warc BOOLEAN NOT NULL DEFAULT false,
+    priority INTEGER NOT NULL DEFAULT 0,
+    weight INTEGER NOT NULL DEFAULT 1 CHECK (weight > 0),
+    virtual_time DOUBLE PRECISION NOT NULL DEFAULT 0
 );
 
 CREATE TABLE edges (
     id           SERIAL PRIMARY KEY,
     source_id    INTEGER NOT NULL REFERENCES page_nodes(id),
     target_id    INTEGER NOT NULL REFERENCES page_nodes(id),
+    kind         TEXT NOT NULL DEFAULT 'navigation',
+    status_code  INTEGER,
+    rel          TEXT,
+    merged_from  INTEGER REFERENCES page_nodes(id),
     CHECK (source_id != target_id)
 );
 
+CREATE UNIQUE INDEX edges_source_id_target_id_kind_idx ON edges (source_id, target_id, kind);
+
 CREATE TABLE tasks (
     id               SERIAL PRIMARY KEY,
     crawl_request_id INTEGER NOT NULL REFERENCES crawl_requests(id),
     page_url         TEXT NOT NULL,
     current_level    INTEGER NOT NULL,
     status           TEXT NOT NULL,
-    seen_url         BOOLEAN NOT NULL
+    seen_url         BOOLEAN NOT NULL,
+    final_url        TEXT,
+    eligible_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    last_error       TEXT,
+    claimed_by       TEXT,
+    lease_expires_at TIMESTAMPTZ
 );
+
+CREATE INDEX tasks_status_crawl_request_id_idx ON tasks (status, crawl_request_id);
+CREATE INDEX tasks_lease_expires_at_idx ON tasks (lease_expires_at) WHERE status = 'IN_PROGRESS';
+CREATE UNIQUE INDEX tasks_crawl_request_id_page_url_idx ON tasks (crawl_request_id, page_url) WHERE NOT seen_url;
+
+CREATE TABLE host_budgets (
+    host            TEXT PRIMARY KEY,
+    next_request_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE host_connections (
+    id         SERIAL PRIMARY KEY,
+    host       TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE page_fetches (
+    id               SERIAL PRIMARY KEY,
+    crawl_request_id INTEGER REFERENCES crawl_requests(id),
+    url              TEXT NOT NULL,
+    canonical_url    TEXT,
+    final_url        TEXT,
+    status_code      INTEGER,
+    headers          JSONB,
+    bytes            BIGINT NOT NULL DEFAULT 0,
+    content_type     TEXT,
+    error_class      TEXT,
+    dns_ms           DOUBLE PRECISION NOT NULL DEFAULT 0,
+    connect_ms       DOUBLE PRECISION NOT NULL DEFAULT 0,
+    tls_ms           DOUBLE PRECISION NOT NULL DEFAULT 0,
+    ttfb_ms          DOUBLE PRECISION NOT NULL DEFAULT 0,
+    total_ms         DOUBLE PRECISION NOT NULL DEFAULT 0,
+    fetched_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX page_fetches_canonical_url_idx ON page_fetches (canonical_url);
+CREATE INDEX page_fetches_crawl_request_id_idx ON page_fetches (crawl_request_id);
+
+CREATE TABLE warc_records (
+    id               SERIAL PRIMARY KEY,
+    crawl_request_id INTEGER NOT NULL REFERENCES crawl_requests(id),
+    record_id        TEXT NOT NULL,
+    record_type      TEXT NOT NULL,
+    target_uri       TEXT NOT NULL,
+    filename         TEXT NOT NULL,
+    record_offset    BIGINT NOT NULL,
+    record_length    BIGINT NOT NULL,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX warc_records_crawl_request_id_idx ON warc_records (crawl_request_id);
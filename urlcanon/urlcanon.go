@@ -0,0 +1,207 @@
+// Package urlcanon canonicalizes urls, so that different spellings of the url
+// of the same page end up as the same page node.
+package urlcanon
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// DefaultStripParams are common tracking query parameters, which don't change
+// the page being requested.
+var DefaultStripParams = []string{
+	"utm_*",
+	"gclid",
+	"dclid",
+	"fbclid",
+	"msclkid",
+	"yclid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+}
+
+// defaultPorts maps schemes to their default port.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Canonicalizer canonicalizes urls. The zero value applies the canonicalization
+// steps that never change which page a url points to: lowercasing the scheme
+// and host, converting internationalized hosts to punycode, dropping default
+// ports, resolving dot segments, sorting query parameters and stripping
+// fragments.
+type Canonicalizer struct {
+	// StripParams are the names of the query parameters removed from every url,
+	// such as tracking parameters. A name ending in "*" matches every
+	// parameter starting with the rest of the name.
+	StripParams []string
+	// UnifySchemes treats http and https urls as the same page, by rewriting
+	// http urls to https. The crawler falls back to http when it can't reach a
+	// rewritten url's host over https.
+	UnifySchemes bool
+	// StripTrailingSlash treats urls with and without a trailing slash at the
+	// end of their path as the same page, by removing the trailing slash.
+	StripTrailingSlash bool
+}
+
+// Canonicalize returns the canonical form of an absolute http or https url.
+func (c *Canonicalizer) Canonicalize(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Unable to canonicalize url %s: scheme must be http or https", rawURL)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Unable to canonicalize url %s: missing host", rawURL)
+	}
+	u.Fragment = ""
+
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return "", fmt.Errorf("Unable to canonicalize host of url %s: %v", rawURL, err)
+	}
+	port := u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if c.UnifySchemes && u.Scheme == "http" {
+		u.Scheme = "https"
+	}
+	if strings.Contains(host, ":") {
+		// ipv6 addresses need to be wrapped in brackets
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	// an escaped slash means something different from a slash, so the path is
+	// only re-escaped if it doesn't contain any
+	if !strings.Contains(strings.ToUpper(u.RawPath), "%2F") {
+		u.RawPath = ""
+	}
+	u.Path = removeDotSegments(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = removeDotSegments(u.RawPath)
+	}
+	if c.StripTrailingSlash && len(u.Path) > 1 {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	u.RawQuery = c.canonicalQuery(u.RawQuery)
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// canonicalHost lowercases a host and converts it to punycode if it's an
+// internationalized domain name.
+func canonicalHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	for _, r := range host {
+		if r >= utf8.RuneSelf {
+			return idna.Lookup.ToASCII(host)
+		}
+	}
+	return host, nil
+}
+
+// removeDotSegments resolves the "." and ".." segments of a path, as described
+// in RFC 3986 section 5.2.4. An empty path becomes "/".
+func removeDotSegments(p string) string {
+	if p == "" {
+		return "/"
+	}
+	var out []string
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			// never remove the empty segment before the leading slash
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	p = strings.Join(out, "/")
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// canonicalQuery removes the parameters in StripParams from a query string
+// and sorts the remaining parameters by name, keeping the order of repeated
+// parameters. Parameters are kept exactly as they're written, since servers
+// don't all decode them the same way, and only empty ones are dropped.
+func (c *Canonicalizer) canonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" || c.strip(paramName(param)) {
+			continue
+		}
+		params = append(params, param)
+	}
+	sort.SliceStable(params, func(i, j int) bool {
+		return paramName(params[i]) < paramName(params[j])
+	})
+	return strings.Join(params, "&")
+}
+
+// paramName returns the name of a raw key[=value] query parameter, as it's
+// written.
+func paramName(param string) string {
+	if i := strings.Index(param, "="); i >= 0 {
+		return param[:i]
+	}
+	return param
+}
+
+// strip reports whether a query parameter is one of StripParams.
+func (c *Canonicalizer) strip(name string) bool {
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		name = unescaped
+	}
+	name = strings.ToLower(name)
+	for _, p := range c.StripParams {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
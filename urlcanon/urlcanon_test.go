@@ -0,0 +1,67 @@
+package urlcanon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalize(t *testing.T) {
+	t.Run("successfully applies the default canonicalization steps", func(tt *testing.T) {
+		c := &Canonicalizer{}
+		cases := map[string]string{
+			"HTTP://Example.com:80/a/../b?utm_source=x": "http://example.com/b?utm_source=x",
+			"http://example.com":                        "http://example.com/",
+			"https://example.com:443/a/./b/#frag":       "https://example.com/a/b/",
+			"http://example.com:8080/?b=2&a=1&b=1":      "http://example.com:8080/?a=1&b=2&b=1",
+			"http://example.com/?":                      "http://example.com/",
+			"http://bücher.example/":                    "http://xn--bcher-kva.example/",
+			"http://example.com./%7Efoo":                "http://example.com/~foo",
+			"http://example.com/a%2Fb":                  "http://example.com/a%2Fb",
+			"http://[::1]:80/":                          "http://[::1]/",
+			"http://example.com/../../a":                "http://example.com/a",
+		}
+		for in, expected := range cases {
+			actual, err := c.Canonicalize(in)
+			assert.NoError(tt, err, in)
+			assert.Equal(tt, expected, actual, in)
+		}
+	})
+
+	t.Run("successfully applies the optional canonicalization steps", func(tt *testing.T) {
+		c := &Canonicalizer{
+			StripParams:        DefaultStripParams,
+			UnifySchemes:       true,
+			StripTrailingSlash: true,
+		}
+		actual, err := c.Canonicalize("HTTP://Example.com:80/a/../b/?utm_source=x&UTM_medium=y&gclid=1&q=go")
+		assert.NoError(tt, err)
+		assert.Equal(tt, "https://example.com/b?q=go", actual)
+		actual, err = c.Canonicalize("http://example.com/")
+		assert.NoError(tt, err)
+		assert.Equal(tt, "https://example.com/", actual)
+	})
+
+	t.Run("successfully sorts query parameters without re-encoding them", func(tt *testing.T) {
+		c := &Canonicalizer{StripParams: DefaultStripParams}
+		cases := map[string]string{
+			"http://example.com/?b&a=1&utm_source=x":        "http://example.com/?a=1&b",
+			"http://example.com/?q=a%20b&p=a+b":             "http://example.com/?p=a+b&q=a%20b",
+			"http://example.com/?q=%7Efoo&a=~bar":           "http://example.com/?a=~bar&q=%7Efoo",
+			"http://example.com/?b=2&&a=1&b=1&utm%5Fmedium": "http://example.com/?a=1&b=2&b=1",
+		}
+		for in, expected := range cases {
+			actual, err := c.Canonicalize(in)
+			assert.NoError(tt, err, in)
+			assert.Equal(tt, expected, actual, in)
+		}
+	})
+
+	t.Run("successfully rejects urls that can't be canonicalized", func(tt *testing.T) {
+		c := &Canonicalizer{}
+		for _, in := range []string{"mailto:someone@example.com", "/relative/path", "http://"} {
+			_, err := c.Canonicalize(in)
+			assert.Error(tt, err, in)
+		}
+	})
+}
@@ -0,0 +1,251 @@
+// Package warc writes WARC 1.1 files, the standard format for archiving http
+// exchanges, as described in https://iipc.github.io/warc-specifications/.
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Record types.
+const (
+	TypeWarcinfo = "warcinfo"
+	TypeRequest  = "request"
+	TypeResponse = "response"
+	TypeMetadata = "metadata"
+)
+
+// DefaultMaxFileSize is the size after which a WARC file is rotated, unless
+// another one is configured.
+const DefaultMaxFileSize = 1 << 30
+
+// Field is a single named field of a WARC record header.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Record represents a single WARC record.
+type Record struct {
+	// Type is one of the record type constants.
+	Type string
+	// ID is the record's WARC-Record-ID, such as
+	// "<urn:uuid:8a5c2f3e-0b1d-4c52-9b1e-2a6f4b7c9d10>". A new one is
+	// generated by NewRecord.
+	ID string
+	// Date is when the record's content was captured.
+	Date time.Time
+	// TargetURI is the url the record is about, if any.
+	TargetURI string
+	// ContentType is the media type of the record's content, such as
+	// "application/http; msgtype=response".
+	ContentType string
+	// Fields holds any other header fields of the record, such as
+	// WARC-Concurrent-To, which are written in order.
+	Fields []Field
+	// Content is the record's content block.
+	Content []byte
+}
+
+// NewRecord creates a new record of the given type with a fresh record id.
+func NewRecord(recordType string, date time.Time) *Record {
+	return &Record{Type: recordType, ID: NewRecordID(), Date: date}
+}
+
+// NewRecordID returns a new random WARC-Record-ID.
+func NewRecordID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	// version 4, variant 10 uuid
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Digest returns the WARC digest of the given bytes, such as
+// "sha1:3I42H3S6NNFQ2MSVX7XZKYAYSCX5QBYJ".
+func Digest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// Add appends a header field to the record.
+func (r *Record) Add(name, value string) {
+	r.Fields = append(r.Fields, Field{Name: name, Value: value})
+}
+
+// marshal returns the uncompressed bytes of the record, including the two
+// newlines ending it.
+func (r *Record) marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString("WARC/1.1\r\n")
+	fmt.Fprintf(&b, "WARC-Type: %s\r\n", r.Type)
+	fmt.Fprintf(&b, "WARC-Record-ID: %s\r\n", r.ID)
+	fmt.Fprintf(&b, "WARC-Date: %s\r\n", r.Date.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	if r.TargetURI != "" {
+		fmt.Fprintf(&b, "WARC-Target-URI: %s\r\n", r.TargetURI)
+	}
+	for _, f := range r.Fields {
+		fmt.Fprintf(&b, "%s: %s\r\n", f.Name, f.Value)
+	}
+	if r.ContentType != "" {
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", r.ContentType)
+	}
+	fmt.Fprintf(&b, "WARC-Block-Digest: %s\r\n", Digest(r.Content))
+	fmt.Fprintf(&b, "Content-Length: %d\r\n", len(r.Content))
+	b.WriteString("\r\n")
+	b.Write(r.Content)
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// Location is where a record was written to.
+type Location struct {
+	// Filename is the name of the WARC file, relative to the writer's
+	// directory.
+	Filename string
+	// Offset and Length are the position and size of the record's gzip member
+	// in the file.
+	Offset int64
+	Length int64
+}
+
+// Config represents the configuration of a Writer.
+type Config struct {
+	// Dir is the directory WARC files are written to. It is created if it
+	// doesn't exist yet.
+	Dir string
+	// Prefix starts the name of every WARC file.
+	Prefix string
+	// MaxFileSize is the size in bytes after which a new WARC file is started.
+	// It defaults to DefaultMaxFileSize.
+	MaxFileSize int64
+	// Info holds the fields of the warcinfo record that starts every WARC
+	// file, such as "software".
+	Info []Field
+}
+
+// Writer writes records to gzip compressed WARC files, compressing every
+// record separately so that single records can be read from the middle of a
+// file. A new file is started once the current one grows past MaxFileSize,
+// and every file starts with a warcinfo record. It is safe for concurrent
+// use.
+type Writer struct {
+	cfg      Config
+	mu       sync.Mutex
+	file     *os.File
+	filename string
+	size     int64
+	serial   int
+	infoID   string
+}
+
+// NewWriter creates a new Writer. No file is created until the first record
+// is written.
+func NewWriter(cfg Config) *Writer {
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = DefaultMaxFileSize
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "crawlr"
+	}
+	return &Writer{cfg: cfg}
+}
+
+// WriteRecords writes the given records one after the other to the same WARC
+// file, and returns where each of them was written to. Every record gets a
+// WARC-Warcinfo-ID pointing at the file's warcinfo record.
+func (w *Writer) WriteRecords(records ...*Record) ([]Location, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil || w.size >= w.cfg.MaxFileSize {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	locations := make([]Location, 0, len(records))
+	for _, r := range records {
+		r.Add("WARC-Warcinfo-ID", w.infoID)
+		loc, err := w.write(r)
+		if err != nil {
+			return locations, err
+		}
+		locations = append(locations, loc)
+	}
+	return locations, nil
+}
+
+// Close closes the current WARC file, if there is one.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// rotate closes the current WARC file and starts a new one with a warcinfo
+// record.
+func (w *Writer) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("Unable to close WARC file %s: %v", w.filename, err)
+		}
+		w.file = nil
+	}
+	if err := os.MkdirAll(w.cfg.Dir, 0755); err != nil {
+		return fmt.Errorf("Unable to create WARC directory %s: %v", w.cfg.Dir, err)
+	}
+	// file names have to be unique across every crawler writing to the same
+	// directory
+	host, _ := os.Hostname()
+	now := time.Now()
+	w.serial++
+	w.filename = fmt.Sprintf("%s-%s-%05d-%d-%s.warc.gz", w.cfg.Prefix, now.UTC().Format("20060102150405"), w.serial, os.Getpid(), host)
+	f, err := os.OpenFile(filepath.Join(w.cfg.Dir, w.filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to create WARC file %s: %v", w.filename, err)
+	}
+	w.file, w.size = f, 0
+
+	info := NewRecord(TypeWarcinfo, now)
+	info.ContentType = "application/warc-fields"
+	info.Add("WARC-Filename", w.filename)
+	var content bytes.Buffer
+	for _, f := range w.cfg.Info {
+		fmt.Fprintf(&content, "%s: %s\r\n", f.Name, f.Value)
+	}
+	info.Content = content.Bytes()
+	w.infoID = info.ID
+	_, err = w.write(info)
+	return err
+}
+
+// write appends a single record to the current WARC file as its own gzip
+// member.
+func (w *Writer) write(r *Record) (Location, error) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(r.marshal())
+	if err := zw.Close(); err != nil {
+		return Location{}, fmt.Errorf("Unable to compress WARC record %s: %v", r.ID, err)
+	}
+	loc := Location{Filename: w.filename, Offset: w.size, Length: int64(b.Len())}
+	n, err := w.file.Write(b.Bytes())
+	w.size += int64(n)
+	if err != nil {
+		return loc, fmt.Errorf("Unable to write WARC record %s to %s: %v", r.ID, w.filename, err)
+	}
+	return loc, nil
+}
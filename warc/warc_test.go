@@ -0,0 +1,83 @@
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	t.Run("successfully writes records that can be read back from their offsets", func(tt *testing.T) {
+		dir, err := ioutil.TempDir("", "warc")
+		assert.NoError(tt, err)
+		defer os.RemoveAll(dir)
+
+		w := NewWriter(Config{Dir: dir, Prefix: "test", Info: []Field{{"software", "crawlr"}}})
+		request := NewRecord(TypeRequest, time.Now())
+		request.TargetURI = "http://example.com/"
+		request.ContentType = "application/http; msgtype=request"
+		request.Content = []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		response := NewRecord(TypeResponse, time.Now())
+		response.TargetURI = "http://example.com/"
+		response.Add("WARC-Concurrent-To", request.ID)
+		response.Content = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n<html></html>")
+		locations, err := w.WriteRecords(request, response)
+		assert.NoError(tt, err)
+		assert.NoError(tt, w.Close())
+		assert.Len(tt, locations, 2)
+
+		f, err := os.Open(filepath.Join(dir, locations[1].Filename))
+		assert.NoError(tt, err)
+		defer f.Close()
+		// the whole file is a valid multi member gzip stream starting with the
+		// warcinfo record
+		zr, err := gzip.NewReader(f)
+		assert.NoError(tt, err)
+		all, err := ioutil.ReadAll(zr)
+		assert.NoError(tt, err)
+		assert.True(tt, strings.HasPrefix(string(all), "WARC/1.1\r\nWARC-Type: warcinfo\r\n"))
+		assert.Contains(tt, string(all), "software: crawlr\r\n")
+		assert.Equal(tt, 3, strings.Count(string(all), "WARC/1.1\r\n"))
+
+		// a single record can be read from the middle of the file
+		member := make([]byte, locations[1].Length)
+		_, err = f.ReadAt(member, locations[1].Offset)
+		assert.NoError(tt, err)
+		zr, err = gzip.NewReader(bytes.NewReader(member))
+		assert.NoError(tt, err)
+		record, err := ioutil.ReadAll(zr)
+		assert.NoError(tt, err)
+		assert.Equal(tt, string(response.marshal()), string(record))
+		assert.Contains(tt, string(record), "WARC-Type: response\r\n")
+		assert.Contains(tt, string(record), "WARC-Concurrent-To: "+request.ID+"\r\n")
+		assert.Contains(tt, string(record), "Content-Length: 57\r\n")
+		assert.True(tt, strings.HasSuffix(string(record), "<html></html>\r\n\r\n"))
+	})
+
+	t.Run("successfully rotates files once they grow too large", func(tt *testing.T) {
+		dir, err := ioutil.TempDir("", "warc")
+		assert.NoError(tt, err)
+		defer os.RemoveAll(dir)
+
+		w := NewWriter(Config{Dir: dir, MaxFileSize: 1})
+		first, err := w.WriteRecords(NewRecord(TypeMetadata, time.Now()))
+		assert.NoError(tt, err)
+		second, err := w.WriteRecords(NewRecord(TypeMetadata, time.Now()))
+		assert.NoError(tt, err)
+		assert.NoError(tt, w.Close())
+		assert.NotEqual(tt, first[0].Filename, second[0].Filename)
+		// both files start with a warcinfo record
+		assert.NotZero(tt, first[0].Offset)
+		assert.NotZero(tt, second[0].Offset)
+		files, err := ioutil.ReadDir(dir)
+		assert.NoError(tt, err)
+		assert.Len(tt, files, 2)
+	})
+}